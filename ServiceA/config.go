@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// padCep restores the leading zero spreadsheets tend to drop (1001000 -> 01001000).
+	padCep = envBool("PAD_CEP", false)
+
+	requestTimeout    = envDuration("REQUEST_TIMEOUT", 60*time.Second)
+	maxRequestTimeout = envDuration("MAX_REQUEST_TIMEOUT", 5*time.Minute)
+	shutdownTimeout   = envDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	traceFlushTimeout = envDuration("TRACE_FLUSH_TIMEOUT", 5*time.Second)
+
+	// shutdownDrainDelay keeps the listener open this long after a shutdown signal, answering
+	// new requests with 503 so load balancers stop routing here before connections are refused.
+	shutdownDrainDelay = envDuration("SHUTDOWN_DRAIN_DELAY", 0)
+
+	// shutdownSignals start the graceful shutdown. Container platforms stop with SIGTERM.
+	shutdownSignals = envSignals("SHUTDOWN_SIGNALS", []os.Signal{os.Interrupt, syscall.SIGTERM})
+
+	// tracingRequired makes a failed tracing setup fatal instead of starting without tracing.
+	tracingRequired = envBool("TRACING_REQUIRED", false)
+
+	// collectorEndpoints are the OTLP gRPC collectors spans are exported to, the first
+	// preferred and the others failed over to in order while it can't be reached.
+	collectorEndpoints = envList("OTEL_EXPORTER_OTLP_ENDPOINTS", []string{"otel-collector:4317"})
+
+	// syncSpans exports each span as it ends instead of in batches, so a single test request
+	// shows up in Jaeger right away. Every span end then waits on the collector: debug only.
+	syncSpans = envBool("SYNC_SPANS", false)
+
+	loadShedHighWater = envInt("LOAD_SHED_HIGH_WATER", 1000)
+
+	// GET /status reports dependency checks run in the background on this schedule.
+	statusCheckInterval = envDuration("STATUS_CHECK_INTERVAL", 30*time.Second)
+	statusCheckTimeout  = envDuration("STATUS_CHECK_TIMEOUT", 5*time.Second)
+
+	// metricsAuthToken protects /metrics when set; unset keeps it open for trusted networks.
+	metricsAuthToken = os.Getenv("METRICS_AUTH_TOKEN")
+
+	// defaultLocale is used for error messages when Accept-Language names no supported language.
+	defaultLocale = envString("DEFAULT_LOCALE", "pt-BR")
+
+	// responseHeaders are set on every response. RESPONSE_HEADERS adds to or overrides the
+	// security defaults; an entry with an empty value removes a default.
+	responseHeaders = envHeaders("RESPONSE_HEADERS", map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+	})
+
+	// timeFormat is how timestamps in responses are serialized: "rfc3339" or "unix".
+	timeFormat = envString("TIME_FORMAT", timeFormatRFC3339)
+
+	// errorFormat is the shape of error bodies: "simple" (ErrorResponse) or "problem"
+	// (RFC 7807 application/problem+json), whose type URIs start with problemTypeBaseURI.
+	errorFormat        = envString("ERROR_FORMAT", errorFormatSimple)
+	problemTypeBaseURI = envString("PROBLEM_TYPE_BASE_URI", "urn:lab02:error:")
+
+	// responseEnvelope wraps successful temperature responses as {"data": ..., "meta": ...}
+	// for gateways that expect every payload in that shape.
+	responseEnvelope = envBool("RESPONSE_ENVELOPE", false)
+
+	// requestIDHeader carries the request ID in and, from ServiceA, on to ServiceB.
+	requestIDHeader = envString("REQUEST_ID_HEADER", "X-Request-ID")
+
+	upstreamTimeout       = envDuration("UPSTREAM_TIMEOUT", 10*time.Second)
+	dialTimeout           = envDuration("DIAL_TIMEOUT", 3*time.Second)
+	tlsHandshakeTimeout   = envDuration("TLS_HANDSHAKE_TIMEOUT", 5*time.Second)
+	responseHeaderTimeout = envDuration("RESPONSE_HEADER_TIMEOUT", 10*time.Second)
+	maxUpstreamBodyBytes  = envInt("MAX_UPSTREAM_BODY_BYTES", 1<<20)
+	minTLSVersion         = envTLSVersion("MIN_TLS_VERSION", tls.VersionTLS12)
+
+	// upstreamRetries is how many more times a GET that got one of retryableStatusCodes is
+	// tried, upstreamRetryBackoff apart and doubling. Unset means no retries; 4xx codes are
+	// only retried when listed explicitly.
+	upstreamRetries      = envInt("UPSTREAM_RETRIES", 0)
+	upstreamRetryBackoff = envDuration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond)
+	retryableStatusCodes = envStatusCodes("RETRYABLE_STATUS_CODES", []int{502, 503, 504})
+
+	// serviceBMaxRedirects is how many redirects a call to ServiceB may follow. ServiceB is
+	// called directly, so none are expected.
+	serviceBMaxRedirects = envInt("SERVICE_B_MAX_REDIRECTS", 0)
+
+	// debugEndpoints mounts POST /debug/echo, which shows clients how their CEP was parsed.
+	debugEndpoints = envBool("DEBUG_ENDPOINTS", false)
+
+	validateBatchMax         = envInt("VALIDATE_BATCH_MAX", 1000)
+	validateBatchConcurrency = envInt("VALIDATE_BATCH_CONCURRENCY", 8)
+)
+
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// envList reads a comma-separated list, dropping blank items.
+func envList(key string, fallback []string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return fallback
+	}
+	return items
+}
+
+// envTLSVersion accepts "1.2" or "1.3"; anything else, including older versions, falls back.
+func envTLSVersion(key string, fallback uint16) uint16 {
+	switch os.Getenv(key) {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	return fallback
+}
+
+// envHeaders parses "Name=value;Other=value" over defaults. Malformed entries are skipped.
+func envHeaders(key string, defaults map[string]string) http.Header {
+	values := maps.Clone(defaults)
+	for _, entry := range strings.Split(os.Getenv(key), ";") {
+		name, value, ok := strings.Cut(entry, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			continue
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+
+	headers := make(http.Header)
+	for name, value := range values {
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+	return headers
+}
+
+// signalsByName are the signals SHUTDOWN_SIGNALS may name, with or without the SIG prefix.
+var signalsByName = map[string]os.Signal{
+	"SIGINT":  os.Interrupt,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// envSignals reads a comma-separated list of signal names. Unknown names are skipped.
+func envSignals(key string, fallback []os.Signal) []os.Signal {
+	var signals []os.Signal
+	for _, name := range envList(key, nil) {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		if sig, ok := signalsByName[name]; ok {
+			signals = append(signals, sig)
+		}
+	}
+	if len(signals) == 0 {
+		return fallback
+	}
+	return signals
+}
+
+// envStatusCodes reads a comma-separated list of HTTP status codes as a set, skipping items
+// that aren't one.
+func envStatusCodes(key string, fallback []int) map[int]bool {
+	codes := make(map[int]bool)
+	for _, item := range envList(key, nil) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			continue
+		}
+		codes[code] = true
+	}
+	if len(codes) == 0 {
+		for _, code := range fallback {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
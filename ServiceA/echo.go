@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adrianodevfullstack/lab02.git/cep"
+)
+
+// CepEcho is the body of POST /debug/echo: the cep field as ServiceA received it and each step
+// parseCep takes with it, for clients to see why a CEP they believe is valid gets a 422.
+type CepEcho struct {
+	ContentType string `json:"content_type"`
+	Received    string `json:"received"`
+	// Runes spells out Received one code point at a time, showing characters that don't print,
+	// such as a non-breaking space or a full-width digit pasted from a document.
+	Runes      []string `json:"runes"`
+	Trimmed    string   `json:"trimmed"`
+	Normalized string   `json:"normalized,omitempty"`
+	Valid      bool     `json:"valid"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// HandlerEcho decodes a request like POST / does and answers with what it made of the CEP,
+// without calling ServiceB. A body that can't be decoded gets the same error POST / gives.
+func HandlerEcho(w http.ResponseWriter, r *http.Request) {
+	data, ok := decodeCepRequest(w, r)
+	if !ok {
+		return
+	}
+
+	echo := CepEcho{
+		ContentType: r.Header.Get("Content-Type"),
+		Received:    data.Cep,
+		Runes:       make([]string, 0, len(data.Cep)),
+		Trimmed:     strings.TrimSpace(data.Cep),
+	}
+	for _, c := range data.Cep {
+		echo.Runes = append(echo.Runes, fmt.Sprintf("%U %q", c, c))
+	}
+	normalized, err := parseCep(data.Cep)
+	echo.Normalized, echo.Valid = normalized, err == nil
+	if invalid := (*cep.InvalidError)(nil); errors.As(err, &invalid) {
+		echo.Error = invalid.Reason.Error()
+	}
+	writeJSON(w, r, http.StatusOK, echo)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error codes are part of the API contract: stable and locale-independent. Only the
+// human-readable message that goes with them is translated.
+const (
+	codeInvalidZipcode       = "invalid_zipcode"
+	codeZipcodeNotFound      = "zipcode_not_found"
+	codeWeatherUnavailable   = "weather_unavailable"
+	codeInvalidPayload       = "invalid_payload"
+	codeInvalidBatchSize     = "invalid_batch_size"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeUpstreamError        = "upstream_error"
+	codeOverloaded           = "overloaded"
+	codeShuttingDown         = "shutting_down"
+	codeUnauthorized         = "unauthorized"
+	codeInternalError        = "internal_error"
+	codeUpstreamTimeout      = "upstream_timeout"
+)
+
+// fallbackLocale is also the language of the legacy "error" field.
+const fallbackLocale = "en"
+
+var messages = map[string]map[string]string{
+	"en": {
+		codeInvalidZipcode:       "invalid zipcode",
+		codeZipcodeNotFound:      "can not find zipcode",
+		codeWeatherUnavailable:   "weather not available for this location",
+		codeInvalidPayload:       "invalid payload",
+		codeInvalidBatchSize:     "ceps must contain between 1 and %d items",
+		codeUnsupportedMediaType: "content type must be application/json",
+		codeUpstreamError:        "upstream error",
+		codeOverloaded:           "service overloaded, try again later",
+		codeShuttingDown:         "service shutting down, try another instance",
+		codeUnauthorized:         "unauthorized",
+		codeInternalError:        "internal error",
+		codeUpstreamTimeout:      "upstream did not answer in time",
+	},
+	"pt-BR": {
+		codeInvalidZipcode:       "CEP inválido",
+		codeZipcodeNotFound:      "CEP não encontrado",
+		codeWeatherUnavailable:   "clima indisponível para esta localização",
+		codeInvalidPayload:       "corpo da requisição inválido",
+		codeInvalidBatchSize:     "ceps deve conter entre 1 e %d itens",
+		codeUnsupportedMediaType: "o Content-Type deve ser application/json",
+		codeUpstreamError:        "falha ao consultar serviço externo",
+		codeOverloaded:           "serviço sobrecarregado, tente novamente em instantes",
+		codeShuttingDown:         "serviço em desligamento, tente outra instância",
+		codeUnauthorized:         "não autorizado",
+		codeInternalError:        "erro interno",
+		codeUpstreamTimeout:      "serviço externo não respondeu a tempo",
+	},
+}
+
+// negotiateLocale returns the first supported language in an Accept-Language header, in the
+// order the client listed them, or DEFAULT_LOCALE when none is supported.
+func negotiateLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		switch language {
+		case "pt":
+			return "pt-BR"
+		case "en":
+			return "en"
+		}
+	}
+	return defaultLocale
+}
+
+func hasMessage(code string) bool {
+	_, ok := messages[fallbackLocale][code]
+	return ok
+}
+
+func localize(locale, code string, args ...any) string {
+	format, ok := messages[locale][code]
+	if !ok {
+		format = messages[fallbackLocale][code]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(format, args...)
+	}
+	return format
+}
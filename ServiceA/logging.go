@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type loggerCtxKey struct{}
+
+// RequestLogger stores a logger tagged with the request ID and client IP in the request
+// context. It must run after middleware.RequestID and middleware.RealIP.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.Default().With(
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("remote_ip", r.RemoteAddr),
+		)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerCtxKey{}, logger)))
+	})
+}
+
+// logFromCtx returns the request's logger, tagged with the trace and span of the span active
+// in ctx so log lines can be matched to traces. Outside a request it falls back to the
+// default logger.
+func logFromCtx(ctx context.Context) *slog.Logger {
+	logger, ok := ctx.Value(loggerCtxKey{}).(*slog.Logger)
+	if !ok {
+		logger = slog.Default()
+	}
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() {
+		logger = logger.With(
+			slog.String("trace_id", spanCtx.TraceID().String()),
+			slog.String("span_id", spanCtx.SpanID().String()),
+		)
+	}
+	return logger
+}
@@ -3,30 +3,30 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
-var validCepRegex = regexp.MustCompile(`^\d{8}$`)
-
 type CepRequest struct {
 	Cep string `json:"cep"`
 }
@@ -38,7 +38,13 @@ type Temperature struct {
 	TempK float64 `json:"temp_K"`
 }
 
-func initProvider() (func(context.Context) error, error) {
+// telemetry is what initProvider sets up, kept so shutdown can tear it down in order.
+type telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	conn           *grpc.ClientConn
+}
+
+func initProvider() (*telemetry, error) {
 	ctx := context.Background()
 
 	res, err := resource.New(ctx,
@@ -51,70 +57,100 @@ func initProvider() (func(context.Context) error, error) {
 	}
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	conn, err := grpc.NewClient("otel-collector:4317", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := newCollectorConn(collectorEndpoints)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
 	}
 
 	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
-	bsp := sdktrace.NewBatchSpanProcessor(traceExporter)
+	var processor sdktrace.SpanProcessor
+	if syncSpans {
+		log.Println("SYNC_SPANS=true: exporting spans synchronously, not for production")
+		processor = sdktrace.NewSimpleSpanProcessor(traceExporter)
+	} else {
+		processor = sdktrace.NewBatchSpanProcessor(traceExporter)
+	}
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		sdktrace.WithSpanProcessor(processor),
 	)
 	otel.SetTracerProvider(tracerProvider)
+	otel.SetErrorHandler(&telemetryErrorHandler{})
 
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
-	return tracerProvider.Shutdown, nil
+	return &telemetry{tracerProvider: tracerProvider, conn: conn}, nil
 }
 
 func main() {
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, shutdownSignals...)
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), shutdownSignals...)
 	defer cancel()
 
-	shutdown, err := initProvider()
+	tel, err := initProvider()
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		if err := shutdown(ctx); err != nil {
-			log.Printf("failed to shutdown TracerProvider: %s", err)
+		if tracingRequired {
+			log.Fatal(err)
 		}
-	}()
+		// Serve traffic without tracing rather than letting a collector outage take the API
+		// down. Incoming trace context is still propagated to downstream calls.
+		log.Printf("WARNING: tracing disabled: %s", err)
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	}
 
+	// middleware.RequestID reuses an incoming ID from this header and generates one otherwise.
+	middleware.RequestIDHeader = requestIDHeader
 	router := chi.NewRouter()
+	router.Use(StaticHeaders(responseHeaders))
 
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
+	router.Use(RequestLogger)
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(60 * time.Second))
-	// promhttp
-	router.Handle("/metrics", promhttp.Handler())
+	router.Use(RejectWhenShuttingDown("/metrics"))
+	router.Use(LoadShedder(int64(loadShedHighWater), "/metrics", "/status"))
+	router.Use(RequestTimeout(requestTimeout, maxRequestTimeout))
+	router.With(RequireToken(metricsAuthToken, "metrics")).Handle("/metrics", metricsHandler(metricsRegistry))
+	status := newStatusMonitor(
+		dependencyCheck{name: "otel-collector", check: anyTCPCheck(collectorEndpoints)},
+		dependencyCheck{name: "serviceb", check: httpCheck(serviceBURL() + "/")},
+	)
+	go status.Run(ctx, statusCheckInterval)
+	router.Get("/status", status.Handler)
 	router.Post("/", ValidateAndProcessCep)
+	router.Post("/validate/batch", ValidateBatch)
+	if debugEndpoints {
+		router.Post("/debug/echo", HandlerEcho)
+	}
+
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	conns := trackConnections(srv)
 
 	go func() {
-		log.Println("Starting server on port 8080")
-		if err := http.ListenAndServe(":8080", router); err != nil {
+		log.Printf("Starting server on port 8080, graceful shutdown on %v", shutdownSignals)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
 	}()
 
 	select {
-	case <-sigCh:
-		log.Println("Shutting down gracefully, CTRL+C pressed...")
+	case sig := <-sigCh:
+		log.Printf("Shutting down gracefully, received %s...", sig)
 	case <-ctx.Done():
 		log.Println("Shutting down due to other reason...")
 	}
+
+	shutdownSequence(srv, conns, tel)
 }
 
 func ValidateAndProcessCep(w http.ResponseWriter, r *http.Request) {
@@ -126,36 +162,119 @@ func ValidateAndProcessCep(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(ctx, "ValidateAndProcessCep")
 	defer span.End()
 
-	var data CepRequest
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid zipcode"})
+	data, ok := decodeCepRequest(w, r)
+	if !ok {
 		return
 	}
 
-	if !validCepRegex.MatchString(data.Cep) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid zipcode"})
+	cep, err := parseCep(data.Cep)
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidZipcode)
 		return
 	}
 
-	temperature, statusCode, err := callServiceB(data.Cep, ctx)
+	reply, statusCode, err := callServiceB(cep, ctx)
 	if err != nil {
-		w.WriteHeader(statusCode)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		var bErr *serviceBError
+		if errors.As(err, &bErr) && hasMessage(bErr.Code) {
+			writeError(w, r, statusCode, bErr.Code)
+			return
+		}
+		logFromCtx(ctx).Error("ServiceB call failed", slog.String("error", err.Error()))
+		if errors.Is(err, errUnexpectedRedirect) {
+			writeErrorDetail(w, r, statusCode, codeUpstreamError, err.Error())
+			return
+		}
+		if timedOut(err) {
+			writeErrorDetail(w, r, statusCode, codeUpstreamTimeout, err.Error())
+			return
+		}
+		writeErrorDetail(w, r, statusCode, codeInternalError, err.Error())
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(temperature)
+	writeData(w, r, http.StatusOK, reply.Temperature, reply.Source)
 }
 
-func callServiceB(cep string, ctx context.Context) (*Temperature, int, error) {
-	serviceBURL := os.Getenv("SERVICE_B_URL")
-	if serviceBURL == "" {
-		serviceBURL = "http://localhost:8090"
+// decodeCepRequest reads the request body as JSON or, for legacy clients, as a form-encoded
+// cep=... field. On failure it has already answered and returns false. A missing cep is left
+// empty for parseCep to reject, whatever the encoding.
+func decodeCepRequest(w http.ResponseWriter, r *http.Request) (CepRequest, bool) {
+	var data CepRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			writeErrorDetail(w, r, http.StatusBadRequest, codeInvalidZipcode, err.Error())
+			return data, false
+		}
+		data.Cep = r.PostForm.Get("cep")
+		return data, true
 	}
-	url := fmt.Sprintf("%s/%s", serviceBURL, cep)
+
+	if !requireJSON(w, r) {
+		return data, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeErrorDetail(w, r, decodeErrorStatus(err), codeInvalidZipcode, describeDecodeError(err))
+		return data, false
+	}
+	return data, true
+}
+
+// describeDecodeError turns a json.Decoder error into a message that points integrators at
+// the offending position or field of their payload.
+func describeDecodeError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at offset %d: %s", syntaxErr.Offset, syntaxErr)
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("field %q must be a %s, got %s (offset %d)", typeErr.Field, typeErr.Type, typeErr.Value, typeErr.Offset)
+	case errors.Is(err, io.EOF):
+		return "request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body ended unexpectedly"
+	}
+	return err.Error()
+}
+
+// decodeErrorStatus is 422 when the body is well-formed JSON with a value of the wrong type,
+// and 400 when it can't be parsed as JSON at all.
+func decodeErrorStatus(err error) int {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+func serviceBURL() string {
+	if url := os.Getenv("SERVICE_B_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8090"
+}
+
+// serviceBError is a non-200 reply from ServiceB. Its code is relayed to our caller so the
+// message can be localized for them.
+type serviceBError struct {
+	Code    string
+	Message string
+}
+
+func (e *serviceBError) Error() string {
+	return e.Message
+}
+
+// serviceBReply is ServiceB's temperature for a CEP. Source is set when ServiceB enveloped its
+// reply and said where the data came from.
+type serviceBReply struct {
+	Temperature *Temperature
+	Source      string
+}
+
+func callServiceB(cep string, ctx context.Context) (*serviceBReply, int, error) {
+	url := fmt.Sprintf("%s/%s", serviceBURL(), url.PathEscape(cep))
 
 	tracer := otel.Tracer("microservice-tracer")
 	ctx, span := tracer.Start(ctx, "callServiceB")
@@ -168,35 +287,53 @@ func callServiceB(cep string, ctx context.Context) (*Temperature, int, error) {
 
 	carrier := propagation.HeaderCarrier(req.Header)
 	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	forwardRequestID(ctx, req)
+	// Hand the remaining budget to ServiceB so a caller's X-Request-Timeout applies end to end.
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(requestTimeoutHeader, time.Until(deadline).Round(time.Millisecond).String())
+	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
+		if errors.Is(err, errUnexpectedRedirect) {
+			return nil, http.StatusBadGateway, fmt.Errorf("failed to call ServiceB: %w", err)
+		}
+		if timedOut(err) {
+			return nil, http.StatusGatewayTimeout, fmt.Errorf("failed to call ServiceB: %w", err)
+		}
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to call ServiceB: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readUpstreamBody(resp.Body)
 	if err != nil {
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var errResp struct {
-			Error string `json:"error"`
-		}
+		var errResp ErrorResponse
 		_ = json.Unmarshal(body, &errResp)
 		errMsg := errResp.Error
 		if errMsg == "" {
 			errMsg = string(body)
 		}
-		return nil, resp.StatusCode, fmt.Errorf("%s", errMsg)
+		return nil, resp.StatusCode, &serviceBError{Code: errResp.Code, Message: errMsg}
 	}
 
-	var temperature Temperature
-	if err := json.Unmarshal(body, &temperature); err != nil {
+	// ServiceB may run with RESPONSE_ENVELOPE too; unwrap its data when it does.
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+		Meta *struct {
+			Source string `json:"source"`
+		} `json:"meta"`
+	}
+	reply := &serviceBReply{Temperature: &Temperature{}}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Data != nil && envelope.Meta != nil {
+		body, reply.Source = envelope.Data, envelope.Meta.Source
+	}
+	if err := json.Unmarshal(body, reply.Temperature); err != nil {
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return &temperature, http.StatusOK, nil
+	return reply, http.StatusOK, nil
 }
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// stubServiceB answers every call with a fixed temperature, recording the paths it was asked
+// for. SERVICE_B_URL points at it for the rest of the test.
+type stubServiceB struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func newStubServiceB(t *testing.T) *stubServiceB {
+	t.Helper()
+	s := &stubServiceB{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.paths = append(s.paths, r.URL.Path)
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"city":"São Paulo","temp_C":21.4,"temp_F":70.52,"temp_K":294.55}`))
+	}))
+	t.Cleanup(s.Close)
+	t.Setenv("SERVICE_B_URL", s.URL)
+	return s
+}
+
+// Paths returns the paths ServiceB was called with so far.
+func (s *stubServiceB) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.paths...)
+}
+
+// postCep sends body to ValidateAndProcessCep as contentType.
+func postCep(contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	ValidateAndProcessCep(rec, req)
+	return rec
+}
+
+func TestValidateAndProcessCepPadding(t *testing.T) {
+	tests := []struct {
+		name       string
+		pad        bool
+		cep        string
+		wantStatus int
+		wantPath   string
+	}{
+		{name: "seven digits padded", pad: true, cep: "1001000", wantStatus: http.StatusOK, wantPath: "/01001000"},
+		{name: "seven digits with whitespace padded", pad: true, cep: " 1001000 ", wantStatus: http.StatusOK, wantPath: "/01001000"},
+		{name: "eight digits untouched", pad: true, cep: "01001000", wantStatus: http.StatusOK, wantPath: "/01001000"},
+		{name: "six digits still rejected", pad: true, cep: "101000", wantStatus: http.StatusUnprocessableEntity},
+		{name: "nine digits still rejected", pad: true, cep: "101001000", wantStatus: http.StatusUnprocessableEntity},
+		{name: "non-digit still rejected", pad: true, cep: "100100a", wantStatus: http.StatusUnprocessableEntity},
+		{name: "seven digits without PAD_CEP", cep: "1001000", wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceB := newStubServiceB(t)
+			setForTest(t, &padCep, tt.pad)
+			setForTest(t, &cepParser, newCepParser(""))
+
+			rec := postCep("application/json", `{"cep":"`+tt.cep+`"}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			paths := serviceB.Paths()
+			switch {
+			case tt.wantPath == "" && len(paths) != 0:
+				t.Errorf("ServiceB was called with %v for an invalid CEP", paths)
+			case tt.wantPath != "" && (len(paths) != 1 || paths[0] != tt.wantPath):
+				t.Errorf("ServiceB was called with %v, want [%s]", paths, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestValidateAndProcessCepErrorLocale(t *testing.T) {
+	setForTest(t, &defaultLocale, "pt-BR")
+	tests := []struct {
+		acceptLanguage string
+		wantMessage    string
+	}{
+		{acceptLanguage: "en", wantMessage: "invalid zipcode"},
+		{acceptLanguage: "pt-BR,pt;q=0.9", wantMessage: "CEP inválido"},
+		{acceptLanguage: "de", wantMessage: "CEP inválido"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"cep":"123"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		ValidateAndProcessCep(rec, req)
+
+		var body ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Accept-Language %q: decoding %s: %s", tt.acceptLanguage, rec.Body, err)
+		}
+		if body.Code != codeInvalidZipcode || body.Error != "invalid zipcode" || body.Message != tt.wantMessage {
+			t.Errorf("Accept-Language %q: body = %+v, want code %q and message %q", tt.acceptLanguage, body, codeInvalidZipcode, tt.wantMessage)
+		}
+	}
+}
+
+func TestValidateAndProcessCepContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+	}{
+		{name: "json", contentType: "application/json", body: `{"cep":"01001000"}`, wantStatus: http.StatusOK},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", body: `{"cep":"01001000"}`, wantStatus: http.StatusOK},
+		{name: "missing", body: `{"cep":"01001000"}`, wantStatus: http.StatusUnsupportedMediaType, wantCode: codeUnsupportedMediaType},
+		{name: "text/plain", contentType: "text/plain", body: `{"cep":"01001000"}`, wantStatus: http.StatusUnsupportedMediaType, wantCode: codeUnsupportedMediaType},
+		// An empty body is an invalid payload rather than the wrong media type; it can't be
+		// parsed, so it is a 400 like any other unparsable body.
+		{name: "empty body without content type", wantStatus: http.StatusBadRequest, wantCode: codeInvalidZipcode},
+		{name: "empty body as text/plain", contentType: "text/plain", wantStatus: http.StatusBadRequest, wantCode: codeInvalidZipcode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceB := newStubServiceB(t)
+
+			rec := postCep(tt.contentType, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != tt.wantCode {
+				t.Errorf("body = %s, want code %q", rec.Body, tt.wantCode)
+			}
+			if paths := serviceB.Paths(); len(paths) != 0 {
+				t.Errorf("ServiceB was called with %v for a rejected request", paths)
+			}
+		})
+	}
+}
+
+func TestValidateAndProcessCepMalformedVsInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "not JSON", body: `cep=01001000`, wantStatus: http.StatusBadRequest},
+		{name: "truncated JSON", body: `{"cep":"0100`, wantStatus: http.StatusBadRequest},
+		{name: "cep of the wrong type", body: `{"cep":1001000}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "cep in the wrong format", body: `{"cep":"0100100"}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "no cep", body: `{}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "valid cep", body: `{"cep":"01001000"}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newStubServiceB(t)
+
+			rec := postCep("application/json", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestValidateBatchMalformedVsInvalid(t *testing.T) {
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{body: `{"ceps":["01001000"`, wantStatus: http.StatusBadRequest},
+		{body: `{"ceps":"01001000"}`, wantStatus: http.StatusUnprocessableEntity},
+		{body: `{"ceps":[]}`, wantStatus: http.StatusUnprocessableEntity},
+		{body: `{"ceps":["01001000"]}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		ValidateBatch(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("POST /validate %s: status = %d, want %d: %s", tt.body, rec.Code, tt.wantStatus, rec.Body)
+		}
+	}
+}
+
+func TestValidateBatchChecksRepeatedCepsOnce(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int)
+	)
+	serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/99999999/address" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"cep":"01001000","city":"São Paulo"}`))
+	}))
+	t.Cleanup(serviceB.Close)
+	t.Setenv("SERVICE_B_URL", serviceB.URL)
+
+	body := `{"ceps":["01001000","99999999","01001000","123","99999999","01001000"]}`
+	req := httptest.NewRequest(http.MethodPost, "/validate?check_existence=true", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ValidateBatch(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got struct{ Results []CepValidation }
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	// "-" is a CEP whose existence wasn't checked.
+	want := []string{"01001000 true", "99999999 false", "01001000 true", "123 -", "99999999 false", "01001000 true"}
+	var results []string
+	for _, r := range got.Results {
+		exists := "-"
+		if r.Exists != nil {
+			exists = strconv.FormatBool(*r.Exists)
+		}
+		results = append(results, r.Cep+" "+exists)
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("results = %q, want %q", results, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, n := range calls {
+		if n != 1 {
+			t.Errorf("ServiceB was asked for %s %d times, want once", path, n)
+		}
+	}
+	if len(calls) != 2 {
+		t.Errorf("ServiceB calls = %v, want one per distinct valid CEP", calls)
+	}
+}
+
+func TestValidateAndProcessCepResponseEnvelope(t *testing.T) {
+	const temperature = `{"city":"São Paulo","temp_C":21.4,"temp_F":70.52,"temp_K":294.55}`
+	tests := []struct {
+		name       string
+		envelope   bool
+		reply      string
+		wantSource string
+	}{
+		{name: "off, bare ServiceB", reply: temperature},
+		{name: "off, enveloped ServiceB", reply: `{"data":` + temperature + `,"meta":{"source":"cache"}}`},
+		{name: "on, bare ServiceB", envelope: true, reply: temperature},
+		{name: "on, enveloped ServiceB", envelope: true, reply: `{"data":` + temperature + `,"meta":{"source":"cache"}}`, wantSource: "cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.reply))
+			}))
+			t.Cleanup(serviceB.Close)
+			t.Setenv("SERVICE_B_URL", serviceB.URL)
+			setForTest(t, &responseEnvelope, tt.envelope)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"cep":"01001000"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(middleware.RequestIDHeader, "req-123")
+			rec := httptest.NewRecorder()
+			middleware.RequestID(http.HandlerFunc(ValidateAndProcessCep)).ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+
+			var got map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %s: %s", rec.Body, err)
+			}
+			if !tt.envelope {
+				if got["city"] == nil || got["data"] != nil || got["meta"] != nil {
+					t.Errorf("body = %s, want the bare temperature", rec.Body)
+				}
+				return
+			}
+			var data Temperature
+			var meta struct {
+				RequestID string `json:"request_id"`
+				Timestamp string
+				Source    string
+			}
+			json.Unmarshal(got["data"], &data)
+			json.Unmarshal(got["meta"], &meta)
+			if data.City != "São Paulo" || data.TempC != 21.4 {
+				t.Errorf("data = %s", got["data"])
+			}
+			if meta.RequestID != "req-123" || meta.Timestamp == "" || meta.Source != tt.wantSource {
+				t.Errorf("meta = %s, want request_id req-123, a timestamp and source %q", got["meta"], tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestValidateBatchKeepsRequestOrder(t *testing.T) {
+	// The first CEP answers last and the last one first; only 02002000 doesn't exist.
+	delays := map[string]time.Duration{"01001000": 60 * time.Millisecond, "02002000": 30 * time.Millisecond, "03003000": 0}
+	serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cep := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/address")
+		time.Sleep(delays[cep])
+		if cep == "02002000" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"cep":"` + cep + `"}`))
+	}))
+	t.Cleanup(serviceB.Close)
+	t.Setenv("SERVICE_B_URL", serviceB.URL)
+
+	body := `{"ceps":["01001000","bad","02002000","03003000"]}`
+	req := httptest.NewRequest(http.MethodPost, "/validate?check_existence=true", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	ValidateBatch(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got struct{ Results []CepValidation }
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	var results []string
+	for _, r := range got.Results {
+		exists := "-"
+		if r.Exists != nil {
+			exists = strconv.FormatBool(*r.Exists)
+		}
+		results = append(results, r.Cep+" "+exists)
+	}
+	if want := []string{"01001000 true", "bad -", "02002000 false", "03003000 true"}; !slices.Equal(results, want) {
+		t.Errorf("results = %q, want %q", results, want)
+	}
+}
+
+func TestValidateAndProcessCepFormAndJSON(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "json", contentType: "application/json", body: `{"cep":"01001000"}`, wantStatus: http.StatusOK},
+		{name: "form", contentType: form, body: "cep=01001000", wantStatus: http.StatusOK},
+		{name: "form with charset and other fields", contentType: form + "; charset=utf-8", body: "source=legacy&cep=01001-000", wantStatus: http.StatusOK},
+		{name: "json without cep", contentType: "application/json", body: `{"zip":"01001000"}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "form without cep", contentType: form, body: "zip=01001000", wantStatus: http.StatusUnprocessableEntity},
+		{name: "form with an empty cep", contentType: form, body: "cep=", wantStatus: http.StatusUnprocessableEntity},
+		{name: "malformed form", contentType: form, body: "cep=%zz", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serviceB := newStubServiceB(t)
+
+			rec := postCep(tt.contentType, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			paths := serviceB.Paths()
+			if tt.wantStatus == http.StatusOK && !slices.Equal(paths, []string{"/01001000"}) {
+				t.Errorf("ServiceB was called with %v, want [/01001000]", paths)
+			}
+			if tt.wantStatus != http.StatusOK {
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != codeInvalidZipcode {
+					t.Errorf("body = %s, want code %q", rec.Body, codeInvalidZipcode)
+				}
+			}
+		})
+	}
+}
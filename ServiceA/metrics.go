@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds everything served on /metrics. It is the service's own registry
+// rather than the global default, so nothing a dependency registers globally ends up served.
+// The collectors below are package variables registered on it once, at init; a test reads
+// one back through the collector itself (prometheus/testutil) or by scraping metricsHandler,
+// not from a registry of its own.
+var (
+	metricsRegistry = newMetricsRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+)
+
+// newMetricsRegistry returns a registry with the Go runtime and process collectors the
+// default registry used to provide.
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// metricsHandler serves reg in the Prometheus exposition format.
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+}
+
+var telemetryErrors = metricsFactory.NewCounter(prometheus.CounterOpts{
+	Name: "otel_errors_total",
+	Help: "OpenTelemetry errors, mostly failed span exports. A rising rate means traces are being lost.",
+})
+
+var (
+	requestsInFlight = metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests currently being served, as seen by the load shedder.",
+	}, func() float64 { return float64(inFlightRequests.Load()) })
+
+	requestsShed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Requests rejected with 503 because the service was over its in-flight limit.",
+	})
+)
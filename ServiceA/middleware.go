@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const requestTimeoutHeader = "X-Request-Timeout"
+
+type requestTimeoutKey struct{}
+
+// RequestTimeout works like middleware.Timeout, but a caller may ask for a different deadline
+// through the X-Request-Timeout header (e.g. "90s"). The override is clamped to max; malformed
+// or non-positive values are ignored and the fallback is used. An override longer than the
+// fallback also lifts the per-call upstream limits, through upstreamBudget.
+func RequestTimeout(fallback, max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := fallback
+			if override, err := time.ParseDuration(r.Header.Get(requestTimeoutHeader)); err == nil && override > 0 {
+				timeout = min(override, max)
+			}
+			if timeout > fallback {
+				r = r.WithContext(context.WithValue(r.Context(), requestTimeoutKey{}, timeout))
+			}
+			middleware.Timeout(timeout)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// upstreamBudget is how long one upstream call made for the request in ctx may take: limit, or
+// the longer timeout its caller asked for with X-Request-Timeout, so a slow job that was given
+// 90s isn't cut off by a 10s per-call limit. The request's own deadline applies either way.
+func upstreamBudget(ctx context.Context, limit time.Duration) time.Duration {
+	if requested, ok := ctx.Value(requestTimeoutKey{}).(time.Duration); ok {
+		return max(requested, limit)
+	}
+	return limit
+}
+
+// RequireToken rejects requests that don't carry token, either as "Authorization: Bearer <token>"
+// or as the basic-auth password (any username). An empty token disables the check.
+func RequireToken(token, realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				_, credential, _ = r.BasicAuth()
+			}
+			if subtle.ConstantTimeCompare([]byte(credential), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+				writeError(w, r, http.StatusUnauthorized, codeUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardRequestID copies the request ID in ctx onto an outbound request to ServiceB, so both
+// services log the same ID for one client call.
+func forwardRequestID(ctx context.Context, req *http.Request) {
+	if id := middleware.GetReqID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// StaticHeaders sets headers on every response before the handler runs, so errors and
+// rejected requests carry them too.
+func StaticHeaders(headers http.Header) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range headers {
+				w.Header()[name] = values
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectWhenShuttingDown answers new requests with 503 and Connection: close once shutdown has
+// begun, while requests already past it run to completion. Paths in exempt are still served.
+func RejectWhenShuttingDown(exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if shuttingDown.Load() && !slices.Contains(exempt, r.URL.Path) {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusServiceUnavailable, codeShuttingDown)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var inFlightRequests atomic.Int64
+
+// LoadShedder rejects requests with 503 once highWater requests are already in flight, so an
+// overloaded instance fails fast instead of piling up work it can't finish in time. Paths in
+// exempt (metrics, health checks) are never shed.
+func LoadShedder(highWater int64, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			defer inFlightRequests.Add(-1)
+			if inFlightRequests.Add(1) > highWater {
+				requestsShed.Inc()
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, codeOverloaded)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
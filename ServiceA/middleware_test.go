@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutOverrideOutlastsUpstreamTimeout(t *testing.T) {
+	setForTest(t, &upstreamTimeout, 50*time.Millisecond)
+	setForTest(t, &responseHeaderTimeout, 50*time.Millisecond)
+	setForTest(t, &upstreamClient, newUpstreamClient())
+
+	// ServiceB takes longer than UPSTREAM_TIMEOUT and RESPONSE_HEADER_TIMEOUT to answer.
+	serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"city":"São Paulo","temp_C":21.4,"temp_F":70.52,"temp_K":294.55}`))
+	}))
+	defer serviceB.Close()
+	t.Setenv("SERVICE_B_URL", serviceB.URL)
+
+	handler := RequestTimeout(time.Second, 5*time.Second)(http.HandlerFunc(ValidateAndProcessCep))
+	post := func(timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"cep":"01001000"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if timeout != "" {
+			req.Header.Set(requestTimeoutHeader, timeout)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post(""); rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), codeUpstreamTimeout) {
+		t.Errorf("without an override, status = %d, want 504 %s: %s", rec.Code, codeUpstreamTimeout, rec.Body)
+	}
+	if rec := post("2s"); rec.Code != http.StatusOK {
+		t.Errorf("with X-Request-Timeout: 2s, status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRequestTimeoutClampsAndIgnoresMalformed(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: time.Second},
+		{header: "garbage", want: time.Second},
+		{header: "-5s", want: time.Second},
+		{header: "200ms", want: 200 * time.Millisecond},
+		{header: "3s", want: 3 * time.Second},
+		{header: "1h", want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			var got time.Duration
+			handler := RequestTimeout(time.Second, 5*time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ := r.Context().Deadline()
+				got = time.Until(deadline)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(requestTimeoutHeader, tt.header)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if got > tt.want || got < tt.want-100*time.Millisecond {
+				t.Errorf("deadline in %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// setForTest sets *p to value until the test ends.
+func setForTest[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	saved := *p
+	*p = value
+	t.Cleanup(func() { *p = saved })
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// writeJSON writes v as the JSON response body with the given status. Output is compact unless
+// the caller asks for ?pretty=true, which indents it with two spaces for reading by hand.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeJSON(w, r, v)
+}
+
+func encodeJSON(w io.Writer, r *http.Request, v any) {
+	enc := json.NewEncoder(w)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// Envelope is the shape of a success body under RESPONSE_ENVELOPE: the payload in Data and
+// what produced it in Meta.
+type Envelope struct {
+	Data any          `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta describes an enveloped response. Source is where ServiceB got the data from,
+// when ServiceB itself enveloped its reply.
+type EnvelopeMeta struct {
+	RequestID string   `json:"request_id,omitempty"`
+	Timestamp jsonTime `json:"timestamp"`
+	Source    string   `json:"source,omitempty"`
+}
+
+// writeData writes a successful temperature payload, wrapped in an Envelope when
+// RESPONSE_ENVELOPE is on and bare otherwise.
+func writeData(w http.ResponseWriter, r *http.Request, status int, v any, source string) {
+	if responseEnvelope {
+		v = Envelope{
+			Data: v,
+			Meta: EnvelopeMeta{
+				RequestID: middleware.GetReqID(r.Context()),
+				Timestamp: jsonTime(time.Now()),
+				Source:    source,
+			},
+		}
+	}
+	writeJSON(w, r, status, v)
+}
+
+// ErrorResponse is the body of every error reply. Error keeps the English text existing
+// clients match on, Code is the stable machine-readable identifier and Message is the same
+// error in the caller's language (Accept-Language).
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func newErrorResponse(r *http.Request, code string, args ...any) ErrorResponse {
+	return ErrorResponse{
+		Error:   localize(fallbackLocale, code, args...),
+		Code:    code,
+		Message: localize(negotiateLocale(r.Header.Get("Accept-Language")), code, args...),
+	}
+}
+
+// writeError replies with the message registered for code, formatted with args.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, args ...any) {
+	writeErrorResponse(w, r, status, newErrorResponse(r, code, args...))
+}
+
+// writeErrorDetail is writeError plus a technical, untranslated detail.
+func writeErrorDetail(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	resp := newErrorResponse(r, code)
+	resp.Detail = detail
+	writeErrorResponse(w, r, status, resp)
+}
+
+const (
+	errorFormatSimple  = "simple"
+	errorFormatProblem = "problem"
+)
+
+// Problem is an error body under ERROR_FORMAT=problem, following RFC 7807. Title is the
+// message in the caller's language, Instance the request ID, and Code carries the stable
+// error code as an extension member, as in ErrorResponse.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// problemType is the type URI of an error code: PROBLEM_TYPE_BASE_URI followed by the code,
+// as stable as the code itself.
+func problemType(code string) string {
+	return problemTypeBaseURI + code
+}
+
+func newProblem(r *http.Request, status int, resp ErrorResponse) Problem {
+	return Problem{
+		Type:     problemType(resp.Code),
+		Title:    resp.Message,
+		Status:   status,
+		Detail:   resp.Detail,
+		Instance: middleware.GetReqID(r.Context()),
+		Code:     resp.Code,
+	}
+}
+
+// writeErrorResponse writes resp in the format ERROR_FORMAT picks.
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, resp ErrorResponse) {
+	if errorFormat == errorFormatProblem {
+		writeProblem(w, r, status, newProblem(r, status, resp))
+		return
+	}
+	writeJSON(w, r, status, resp)
+}
+
+// writeProblem writes a Problem as application/problem+json.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	encodeJSON(w, r, v)
+}
+
+// requireJSON answers 415 unless the request declares a JSON body (parameters such as charset
+// are ignored). An empty body is let through so the decoder rejects it as an invalid payload.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		return true
+	}
+	writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType)
+	return false
+}
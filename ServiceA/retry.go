@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// retryTransport repeats GET requests whose response status is in statuses, up to retries
+// more times, waiting backoff, then twice that, and so on between attempts. Errors and every
+// other status are returned as they are; the caller's context bounds the whole sequence.
+type retryTransport struct {
+	next     http.RoundTripper
+	retries  int
+	statuses map[int]bool
+	backoff  time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || attempt == t.retries || !t.statuses[resp.StatusCode] {
+			return resp, err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, int64(maxUpstreamBodyBytes)))
+		resp.Body.Close()
+
+		timer := time.NewTimer(t.backoff << attempt)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateAndProcessCepRetriesCustomStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{name: "520 listed", env: "502,503,504,520", wantStatus: http.StatusOK, wantCalls: 2},
+		{name: "default list", wantStatus: 520, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Cloudflare's "web server is down", once.
+				if calls.Add(1) == 1 {
+					w.WriteHeader(520)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"city":"São Paulo","temp_C":21.4,"temp_F":70.52,"temp_K":294.55}`))
+			}))
+			t.Cleanup(serviceB.Close)
+			t.Setenv("SERVICE_B_URL", serviceB.URL)
+			t.Setenv("RETRYABLE_STATUS_CODES", tt.env)
+			setForTest(t, &retryableStatusCodes, envStatusCodes("RETRYABLE_STATUS_CODES", []int{502, 503, 504}))
+			setForTest(t, &upstreamRetries, 2)
+			setForTest(t, &upstreamRetryBackoff, time.Millisecond)
+			setForTest(t, &upstreamClient, newUpstreamClient())
+
+			rec := postCep("application/json", `{"cep":"01001000"}`)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("ServiceB called %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
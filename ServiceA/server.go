@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is set when the shutdown sequence starts; RejectWhenShuttingDown turns new
+// requests away from then on.
+var shuttingDown atomic.Bool
+
+// connCounter keeps track of the connections a server currently holds open.
+type connCounter struct {
+	open atomic.Int64
+}
+
+func trackConnections(srv *http.Server) *connCounter {
+	conns := &connCounter{}
+	srv.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			conns.open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			conns.open.Add(-1)
+		}
+	}
+	return conns
+}
+
+// shutdownServer stops accepting new connections and waits up to timeout for in-flight requests.
+// Whatever is still open after that (e.g. a request stuck on a hung upstream) is force-closed,
+// so the process always exits in bounded time.
+func shutdownServer(srv *http.Server, conns *connCounter, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if err == nil {
+		log.Println("HTTP server drained")
+		return
+	}
+	log.Printf("graceful drain did not finish within %s: %s", timeout, err)
+
+	remaining := conns.open.Load()
+	if err := srv.Close(); err != nil {
+		log.Printf("failed to close HTTP server: %s", err)
+	}
+	log.Printf("force-closed %d connection(s)", remaining)
+}
+
+// shutdownSequence stops the service in dependency order, each stage with its own deadline:
+// stop accepting and drain requests, flush pending spans and stop the exporter, and only then
+// close the collector connection those spans travel over.
+func shutdownSequence(srv *http.Server, conns *connCounter, tel *telemetry) {
+	shuttingDown.Store(true)
+	if shutdownDrainDelay > 0 {
+		log.Printf("shutdown: rejecting new requests for %s before draining", shutdownDrainDelay)
+		time.Sleep(shutdownDrainDelay)
+	}
+
+	log.Println("shutdown 1/3: draining HTTP server")
+	shutdownServer(srv, conns, shutdownTimeout)
+
+	if tel == nil {
+		log.Println("shutdown complete (tracing was disabled)")
+		return
+	}
+
+	log.Println("shutdown 2/3: flushing spans")
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	if err := tel.tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("failed to shutdown TracerProvider: %s", err)
+	}
+	cancel()
+
+	log.Println("shutdown 3/3: closing collector connection")
+	if err := tel.conn.Close(); err != nil {
+		log.Printf("failed to close collector connection: %s", err)
+	}
+	log.Println("shutdown complete")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	dependencyUp      = "up"
+	dependencyDown    = "down"
+	dependencyUnknown = "unknown"
+)
+
+// DependencyStatus is the last background check of one dependency.
+type DependencyStatus struct {
+	Name        string    `json:"name"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	LastChecked *jsonTime `json:"last_checked,omitempty"`
+}
+
+type StatusResponse struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// statusMonitor probes dependencies in the background so GET /status answers from the last
+// results instead of making the caller wait on live probes.
+type statusMonitor struct {
+	checks []dependencyCheck
+
+	mu      sync.RWMutex
+	results []DependencyStatus
+}
+
+func newStatusMonitor(checks ...dependencyCheck) *statusMonitor {
+	results := make([]DependencyStatus, len(checks))
+	for i, c := range checks {
+		results[i] = DependencyStatus{Name: c.name, Status: dependencyUnknown}
+	}
+	return &statusMonitor{checks: checks, results: results}
+}
+
+// Run checks every dependency right away and then every interval, until ctx is done.
+func (m *statusMonitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *statusMonitor) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, c := range m.checks {
+		wg.Go(func() {
+			checkCtx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+			defer cancel()
+
+			result := DependencyStatus{Name: c.name, Status: dependencyUp}
+			if err := c.check(checkCtx); err != nil {
+				result.Status, result.Error = dependencyDown, err.Error()
+			}
+			result.LastChecked = newJSONTime(time.Now().UTC())
+
+			m.mu.Lock()
+			m.results[i] = result
+			m.mu.Unlock()
+		})
+	}
+	wg.Wait()
+}
+
+// Handler reports "ok" when every dependency was up at its last check, "degraded" otherwise.
+// It always answers 200: the service itself is serving, and the body says what isn't.
+func (m *statusMonitor) Handler(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	response := StatusResponse{Status: "ok", Dependencies: append([]DependencyStatus(nil), m.results...)}
+	m.mu.RUnlock()
+
+	for _, dep := range response.Dependencies {
+		if dep.Status != dependencyUp {
+			response.Status = "degraded"
+		}
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// tcpCheck reports whether something accepts connections on addr.
+func tcpCheck(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// anyTCPCheck passes when any of addrs accepts a TCP connection, for redundant dependencies
+// such as failover collectors, which are only down when all of them are.
+func anyTCPCheck(addrs []string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, addr := range addrs {
+			err := tcpCheck(addr)(ctx)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// httpCheck reports whether url answers over HTTP at all. Any response below 500 counts,
+// redirects included: the point is reachability, not whether that particular path exists.
+func httpCheck(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := upstreamClient.Transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+const telemetryErrorLogInterval = time.Minute
+
+// collectorDialOptions keep the collector connection recoverable for the life of the process.
+// gRPC reconnects on its own when the collector restarts; keepalive pings catch connections
+// that died silently (e.g. behind a NAT), and the backoff caps how long a reconnect waits.
+// Pings only go out while an export is in flight, and no more than every 5 minutes, which is
+// what a gRPC server accepts by default before answering with GOAWAY "too_many_pings".
+func collectorDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    5 * time.Minute,
+			Timeout: 20 * time.Second,
+		}),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 30 * time.Second},
+			MinConnectTimeout: 5 * time.Second,
+		}),
+	}
+}
+
+// newCollectorConn connects to the collectors at endpoints. With more than one, gRPC's
+// pick_first balancer gets them all: it uses the first that accepts a connection, in list
+// order, and when that connection breaks it starts again from the top. The primary is
+// therefore used whenever it is reachable, whether it is down at startup or fails later, and
+// spans return to it on the first reconnect after it recovers.
+func newCollectorConn(endpoints []string) (*grpc.ClientConn, error) {
+	if len(endpoints) == 1 {
+		return grpc.NewClient(endpoints[0], collectorDialOptions()...)
+	}
+	addresses := make([]resolver.Address, len(endpoints))
+	for i, endpoint := range endpoints {
+		addresses[i] = resolver.Address{Addr: endpoint}
+	}
+	collectors := manual.NewBuilderWithScheme("otel-collectors")
+	collectors.InitialState(resolver.State{Addresses: addresses})
+	return grpc.NewClient(collectors.Scheme()+":///", append(collectorDialOptions(), grpc.WithResolvers(collectors))...)
+}
+
+// telemetryErrorHandler receives OpenTelemetry's internal errors, mostly failed span exports.
+// Each is counted in otel_errors_total; the log gets at most one line per minute, with the
+// number of errors held back since, so a collector outage shows up without flooding it.
+type telemetryErrorHandler struct {
+	mu         sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+func (h *telemetryErrorHandler) Handle(err error) {
+	telemetryErrors.Inc()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.lastLog) < telemetryErrorLogInterval {
+		h.suppressed++
+		return
+	}
+	log.Printf("WARNING: tracing degraded: %s (%d more error(s) since last report)", err, h.suppressed)
+	h.lastLog, h.suppressed = time.Now(), 0
+}
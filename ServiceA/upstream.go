@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamClient is shared by every outbound call so connections are reused. Connecting,
+// the TLS handshake and waiting for response headers each have their own limit, so an
+// unreachable upstream fails fast while a slow-but-alive one still gets the full timeout.
+var upstreamClient = newUpstreamClient()
+
+func newUpstreamClient() *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	transport.TLSClientConfig = &tls.Config{MinVersion: minTLSVersion}
+
+	client := &http.Client{
+		Transport:     budgetTransport{next: transport, timeout: upstreamTimeout, headerTimeout: responseHeaderTimeout},
+		CheckRedirect: checkRedirect,
+	}
+	if upstreamRetries > 0 {
+		client.Transport = retryTransport{
+			next:     client.Transport,
+			retries:  upstreamRetries,
+			statuses: retryableStatusCodes,
+			backoff:  upstreamRetryBackoff,
+		}
+	}
+	return client
+}
+
+// errResponseHeaderTimeout is how budgetTransport reports RESPONSE_HEADER_TIMEOUT running out.
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// timedOut reports whether err is a call to ServiceB running out of time or being canceled,
+// as opposed to ServiceB failing.
+func timedOut(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, errResponseHeaderTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// budgetTransport limits each upstream call to timeout, and the wait for its response headers
+// to headerTimeout. It takes the place of http.Client.Timeout and the transport's
+// ResponseHeaderTimeout, which are fixed for the client, so that a request given a longer
+// X-Request-Timeout gets the longer limits; see upstreamBudget.
+type budgetTransport struct {
+	next          http.RoundTripper
+	timeout       time.Duration
+	headerTimeout time.Duration
+}
+
+func (t budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	ctx, cancelHeaders := context.WithCancelCause(parent)
+	ctx, cancel := context.WithTimeout(ctx, upstreamBudget(parent, t.timeout))
+	release := func() {
+		cancel()
+		cancelHeaders(nil)
+	}
+	headers := time.AfterFunc(upstreamBudget(parent, t.headerTimeout), func() { cancelHeaders(errResponseHeaderTimeout) })
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	headers.Stop()
+	if err != nil {
+		// Report our own limits rather than a bare "context canceled".
+		if cause := context.Cause(ctx); cause != nil && parent.Err() == nil {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		release()
+		return nil, err
+	}
+	// The limit covers reading the body too, so it is only released once that is closed.
+	resp.Body = releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// errUnexpectedRedirect means ServiceB answered with more redirects than
+// SERVICE_B_MAX_REDIRECTS allows, which usually points at a misconfigured proxy in between.
+var errUnexpectedRedirect = errors.New("unexpected redirect")
+
+// checkRedirect follows at most serviceBMaxRedirects redirects. ServiceB is meant to be
+// called directly, so by default any redirect is an error rather than a hop to wherever
+// it points.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > serviceBMaxRedirects {
+		return fmt.Errorf("%w to %s: more than SERVICE_B_MAX_REDIRECTS=%d", errUnexpectedRedirect, req.URL.Redacted(), serviceBMaxRedirects)
+	}
+	return nil
+}
+
+// readUpstreamBody reads at most maxUpstreamBodyBytes from an upstream response. A body that
+// doesn't fit is reported as an error rather than silently truncated, since a cut-off JSON
+// document can't be decoded anyway.
+func readUpstreamBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, int64(maxUpstreamBodyBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUpstreamBodyBytes {
+		return nil, fmt.Errorf("upstream response exceeds %d bytes", maxUpstreamBodyBytes)
+	}
+	return data, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateAndProcessCepServiceBRedirects(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRedirects int
+		loop         bool
+		wantStatus   int
+	}{
+		{name: "none allowed by default", wantStatus: http.StatusBadGateway},
+		{name: "one allowed, one taken", maxRedirects: 1, wantStatus: http.StatusOK},
+		{name: "one allowed, loop", maxRedirects: 1, loop: true, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var moved int
+			serviceB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasPrefix(r.URL.Path, "/moved/"):
+					moved++
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"city":"São Paulo","temp_C":21.4,"temp_F":70.52,"temp_K":294.55}`))
+				case tt.loop:
+					http.Redirect(w, r, r.URL.Path, http.StatusFound)
+				default:
+					http.Redirect(w, r, "/moved"+r.URL.Path, http.StatusMovedPermanently)
+				}
+			}))
+			t.Cleanup(serviceB.Close)
+			t.Setenv("SERVICE_B_URL", serviceB.URL)
+			setForTest(t, &serviceBMaxRedirects, tt.maxRedirects)
+
+			rec := postCep("application/json", `{"cep":"01001000"}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var body ErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if body.Code != codeUpstreamError || !strings.Contains(body.Detail, "SERVICE_B_MAX_REDIRECTS") {
+				t.Errorf("body = %s, want %q naming SERVICE_B_MAX_REDIRECTS", rec.Body, codeUpstreamError)
+			}
+			if moved != 0 {
+				t.Errorf("the redirect target was called %d times, want 0", moved)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type ValidateBatchRequest struct {
+	Ceps []string `json:"ceps"`
+}
+
+type CepValidation struct {
+	Cep    string `json:"cep"`
+	Valid  bool   `json:"valid"`
+	Exists *bool  `json:"exists,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidateBatch checks the format of every CEP in the payload and, with ?check_existence=true,
+// asks ServiceB's address-only endpoint whether each well-formed CEP exists. Weather is never
+// fetched here. Results keep the order of the request.
+func ValidateBatch(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "ValidateBatch")
+	defer span.End()
+
+	if !requireJSON(w, r) {
+		return
+	}
+
+	var data ValidateBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeErrorDetail(w, r, decodeErrorStatus(err), codeInvalidPayload, describeDecodeError(err))
+		return
+	}
+	if len(data.Ceps) == 0 || len(data.Ceps) > validateBatchMax {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidBatchSize, validateBatchMax)
+		return
+	}
+
+	checkExistence, _ := strconv.ParseBool(r.URL.Query().Get("check_existence"))
+	span.SetAttributes(
+		attribute.Int("batch.size", len(data.Ceps)),
+		attribute.Bool("batch.check_existence", checkExistence),
+	)
+
+	// results[i] is always data.Ceps[i]: checks finish in any order, but each writes only its
+	// own index.
+	results := make([]CepValidation, len(data.Ceps))
+	// A CEP repeated in the batch is checked once; duplicateOf points each repeat at the
+	// position whose result it copies.
+	firstSeen := make(map[string]int)
+	duplicateOf := make(map[int]int)
+	sem := make(chan struct{}, validateBatchConcurrency)
+	var wg sync.WaitGroup
+	for i, raw := range data.Ceps {
+		cep, err := parseCep(raw)
+		results[i] = CepValidation{Cep: raw, Valid: err == nil}
+		if !checkExistence || !results[i].Valid {
+			continue
+		}
+		if j, seen := firstSeen[cep]; seen {
+			duplicateOf[i] = j
+			continue
+		}
+		firstSeen[cep] = i
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			exists, err := checkCepExists(ctx, cep)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Exists = &exists
+		})
+	}
+	wg.Wait()
+	for i, j := range duplicateOf {
+		results[i].Exists, results[i].Error = results[j].Exists, results[j].Error
+	}
+	span.SetAttributes(attribute.Int("batch.duplicates", len(duplicateOf)))
+
+	writeJSON(w, r, http.StatusOK, map[string][]CepValidation{"results": results})
+}
+
+// checkCepExists asks ServiceB for the address of cep; a 404 means the CEP does not exist.
+func checkCepExists(ctx context.Context, cep string) (bool, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "checkCepExists")
+	defer span.End()
+
+	url := fmt.Sprintf("%s/%s/address", serviceBURL(), url.PathEscape(cep))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	forwardRequestID(ctx, req)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to call ServiceB: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("ServiceB returned %d", resp.StatusCode)
+	}
+}
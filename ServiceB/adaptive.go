@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveTimeoutWindow is how many recent calls the percentile is taken over.
+	adaptiveTimeoutWindow = 200
+	// adaptiveTimeoutMinSamples calls are needed before the timeout adapts at all.
+	adaptiveTimeoutMinSamples = 20
+	// adaptiveTimeoutHeadroom multiplies the percentile, so a call slightly slower than
+	// recent ones isn't cut off.
+	adaptiveTimeoutHeadroom = 1.5
+)
+
+// adaptiveTimeout derives a provider's per-call timeout from a percentile of its recent
+// latencies, clamped to [floor, ceiling]. Until enough calls have been seen, and whenever
+// adaptation is disabled, it is the ceiling (the static timeout).
+//
+// Calls that time out are recorded at the timeout they were given. That keeps a provider
+// that turns slow from being held to a timeout it can no longer meet: each timeout pushes
+// the percentile up until calls fit again.
+type adaptiveTimeout struct {
+	provider   string
+	enabled    bool
+	percentile float64
+	floor      time.Duration
+	ceiling    time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	current time.Duration
+}
+
+func newAdaptiveTimeout(provider string, ceiling time.Duration) *adaptiveTimeout {
+	percentile := adaptiveTimeoutPercentile
+	if percentile <= 0 || percentile > 1 {
+		percentile = 0.99
+	}
+	t := &adaptiveTimeout{
+		provider:   provider,
+		enabled:    adaptiveTimeoutEnabled,
+		percentile: percentile,
+		floor:      min(adaptiveTimeoutFloor, ceiling),
+		ceiling:    ceiling,
+		current:    ceiling,
+	}
+	upstreamTimeoutSeconds.WithLabelValues(labelValue("provider", provider)).Set(ceiling.Seconds())
+	return t
+}
+
+// Timeout is the deadline the next call should get.
+func (t *adaptiveTimeout) Timeout() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// Do runs call under the current timeout and records how long it took. Only completed calls
+// and timeouts are recorded; a call that failed fast says nothing about latency.
+func (t *adaptiveTimeout) Do(ctx context.Context, call func(ctx context.Context) error) error {
+	timeout := upstreamBudget(ctx, t.Timeout())
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := call(callCtx)
+	switch {
+	case errors.Is(callCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+		t.observe(min(timeout, t.ceiling))
+	case err == nil || errors.Is(err, errCepNotFound):
+		t.observe(time.Since(start))
+	}
+	return err
+}
+
+func (t *adaptiveTimeout) observe(d time.Duration) {
+	if !t.enabled {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < adaptiveTimeoutWindow {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % adaptiveTimeoutWindow
+	}
+	if len(t.samples) < adaptiveTimeoutMinSamples {
+		return
+	}
+
+	sorted := slices.Clone(t.samples)
+	slices.Sort(sorted)
+	rank := int(math.Ceil(t.percentile*float64(len(sorted)))) - 1
+	p := sorted[max(rank, 0)]
+	t.current = min(max(time.Duration(float64(p)*adaptiveTimeoutHeadroom), t.floor), t.ceiling)
+	upstreamTimeoutSeconds.WithLabelValues(labelValue("provider", t.provider)).Set(t.current.Seconds())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jsonDuration is a time.Duration that travels as a string such as "5m" in JSON.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %w", err)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// RuntimeConfig is the whitelisted set of parameters operators may change on a running
+// instance. Handlers read it once per request through runtimeConfig.Load.
+//
+// Settings baked into long-lived objects at startup stay out: timeouts, breaker thresholds and
+// TLS live in the HTTP client and provider chains, and the geocoder limits implement a
+// provider's usage policy, which isn't something to loosen at runtime.
+type RuntimeConfig struct {
+	CepCacheTTL        jsonDuration `json:"cep_cache_ttl"`
+	NegativeCacheTTL   jsonDuration `json:"negative_cache_ttl"`
+	AverageMaxCeps     int          `json:"average_max_ceps"`
+	AverageConcurrency int          `json:"average_concurrency"`
+	// UpstreamRetries is read by every upstream call, UPSTREAM_RETRIES at startup.
+	UpstreamRetries int `json:"upstream_retries"`
+	// UpstreamMaxConcurrency is applied to upstreamLimiter on update, UPSTREAM_MAX_CONCURRENCY
+	// at startup; 0 means no limit.
+	UpstreamMaxConcurrency int `json:"upstream_max_concurrency"`
+}
+
+func (c RuntimeConfig) validate() error {
+	switch {
+	case c.CepCacheTTL <= 0:
+		return fmt.Errorf("cep_cache_ttl must be positive")
+	case c.NegativeCacheTTL <= 0:
+		return fmt.Errorf("negative_cache_ttl must be positive")
+	case c.AverageMaxCeps <= 0:
+		return fmt.Errorf("average_max_ceps must be positive")
+	case c.AverageConcurrency <= 0:
+		return fmt.Errorf("average_concurrency must be positive")
+	case c.UpstreamRetries < 0:
+		return fmt.Errorf("upstream_retries must not be negative")
+	case c.UpstreamMaxConcurrency < 0:
+		return fmt.Errorf("upstream_max_concurrency must not be negative")
+	}
+	return nil
+}
+
+// configStore hands out immutable RuntimeConfig snapshots. Readers never block; updates are
+// serialized so two partial updates can't overwrite each other's fields.
+type configStore struct {
+	current atomic.Pointer[RuntimeConfig]
+	mu      sync.Mutex
+}
+
+func newConfigStore(initial RuntimeConfig) *configStore {
+	store := &configStore{}
+	store.current.Store(&initial)
+	return store
+}
+
+func (s *configStore) Load() *RuntimeConfig {
+	return s.current.Load()
+}
+
+// Update applies a partial JSON document on top of the current config. Unknown fields and
+// invalid values reject the whole update.
+func (s *configStore) Update(patch []byte) (*RuntimeConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := *s.current.Load()
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		return nil, err
+	}
+	if err := next.validate(); err != nil {
+		return nil, err
+	}
+	s.current.Store(&next)
+	// Under mu, so the limiter ends up matching the last update to be stored.
+	upstreamLimiter.SetCapacity(next.UpstreamMaxConcurrency)
+	return &next, nil
+}
+
+func HandlerGetConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, runtimeConfig.Load())
+}
+
+// HandlerUpdateConfig applies a partial update, e.g. {"cep_cache_ttl": "1h"}, and returns the
+// effective config.
+func HandlerUpdateConfig(w http.ResponseWriter, r *http.Request) {
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		writeErrorDetail(w, r, http.StatusUnprocessableEntity, codeInvalidPayload, err.Error())
+		return
+	}
+
+	cfg, err := runtimeConfig.Update(patch)
+	if err != nil {
+		writeErrorDetail(w, r, http.StatusUnprocessableEntity, codeInvalidPayload, err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, cfg)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// isolateRuntimeConfig gives the test its own runtime config, upstream limiter and client, so
+// updates made through /admin/config don't outlive it.
+func isolateRuntimeConfig(t *testing.T) {
+	t.Helper()
+	setForTest(t, &runtimeConfig, newConfigStore(*runtimeConfig.Load()))
+	setForTest(t, &upstreamLimiter, newFairLimiter(0, 0))
+	setForTest(t, &upstreamRetryBackoff, time.Millisecond)
+	setForTest(t, &upstreamClient, newUpstreamClient())
+}
+
+func postConfig(t *testing.T, patch string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	HandlerUpdateConfig(rec, httptest.NewRequest(http.MethodPost, "/admin/config", strings.NewReader(patch)))
+	return rec
+}
+
+func TestUpdateConfigUpstreamRetries(t *testing.T) {
+	isolateRuntimeConfig(t)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	get := func() int {
+		resp, err := upstreamClient.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	postConfig(t, `{"upstream_retries": 0}`)
+	if status := get(); status != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("without retries: status %d after %d calls", status, calls.Load())
+	}
+	calls.Store(0)
+	if rec := postConfig(t, `{"upstream_retries": 2}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"upstream_retries":2`) {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+	if status := get(); status != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("with 2 retries: status %d after %d calls, want 200 after 3", status, calls.Load())
+	}
+}
+
+func TestUpdateConfigUpstreamMaxConcurrency(t *testing.T) {
+	isolateRuntimeConfig(t)
+	var inFlight, peak atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer upstream.Close()
+	burst := func() int32 {
+		peak.Store(0)
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Go(func() {
+				resp, err := upstreamClient.Get(upstream.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			})
+		}
+		wg.Wait()
+		return peak.Load()
+	}
+
+	if rec := postConfig(t, `{"upstream_max_concurrency": 1}`); rec.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+	if p := burst(); p != 1 {
+		t.Errorf("with upstream_max_concurrency 1, %d calls were in flight at once", p)
+	}
+	postConfig(t, `{"upstream_max_concurrency": 0}`)
+	if p := burst(); p < 2 {
+		t.Errorf("with no limit, calls ran one at a time")
+	}
+}
+
+func TestUpdateConfigRejectsInvalid(t *testing.T) {
+	isolateRuntimeConfig(t)
+	before := *runtimeConfig.Load()
+	for _, patch := range []string{
+		`{"upstream_retries": -1}`,
+		`{"upstream_max_concurrency": -2}`,
+		`{"cep_cache_ttl": "0s"}`,
+		`{"upstream_timeout": "1s"}`,
+	} {
+		if rec := postConfig(t, patch); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422", patch, rec.Code)
+		}
+	}
+	if *runtimeConfig.Load() != before {
+		t.Errorf("rejected updates changed the config to %+v", *runtimeConfig.Load())
+	}
+}
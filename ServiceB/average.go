@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/adrianodevfullstack/lab02.git/temperature"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type AverageRequest struct {
+	Ceps []string `json:"ceps"`
+}
+
+// TemperatureValue is a temperature in the three scales, without a city.
+type TemperatureValue = temperature.Temperature
+
+// AverageResult and AverageFailure carry Index, the CEP's position in the request, since
+// splitting a batch into results and failed leaves neither array aligned with it.
+type AverageResult struct {
+	Index       int         `json:"index"`
+	Cep         string      `json:"cep"`
+	Temperature Temperature `json:"temperature"`
+}
+
+type AverageFailure struct {
+	Index   int    `json:"index"`
+	Cep     string `json:"cep"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AverageResponse summarizes the CEPs that could be resolved; Mean, Min and Max are left out
+// when none could. Results and Failed are each in request order, however the lookups finish.
+type AverageResponse struct {
+	Count   int               `json:"count"`
+	Mean    *TemperatureValue `json:"mean,omitempty"`
+	Min     *TemperatureValue `json:"min,omitempty"`
+	Max     *TemperatureValue `json:"max,omitempty"`
+	Results []AverageResult   `json:"results"`
+	Failed  []AverageFailure  `json:"failed"`
+}
+
+func newTemperatureValue(tempC float64) *TemperatureValue {
+	value := temperature.FromCelsius(tempC)
+	return &value
+}
+
+// HandlerAverage fetches the temperature of several CEPs concurrently and returns their
+// mean, min and max. CEPs that fail are reported in "failed" and left out of the statistics
+// instead of failing the whole request.
+func HandlerAverage(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "HandlerAverage")
+	defer span.End()
+
+	var data AverageRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeErrorDetail(w, r, decodeErrorStatus(err), codeInvalidPayload, err.Error())
+		return
+	}
+	cfg := runtimeConfig.Load()
+	if len(data.Ceps) == 0 || len(data.Ceps) > cfg.AverageMaxCeps {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidBatchSize, cfg.AverageMaxCeps)
+		return
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(data.Ceps)))
+
+	locale := negotiateLocale(r.Header.Get("Accept-Language"))
+	// Lookups finish in any order; each writes only its own index, which fixes the order of
+	// the response.
+	temperatures := make([]*Temperature, len(data.Ceps))
+	codes := make([]string, len(data.Ceps))
+	// A CEP repeated in the batch is fetched once; duplicateOf points each repeat at the
+	// position whose result it copies, so repeats still count toward the aggregates.
+	firstSeen := make(map[string]int)
+	duplicateOf := make(map[int]int)
+	sem := make(chan struct{}, cfg.AverageConcurrency)
+	var wg sync.WaitGroup
+	for i, raw := range data.Ceps {
+		cep, err := parseCep(raw)
+		if err != nil {
+			codes[i] = codeInvalidZipcode
+			continue
+		}
+		if j, seen := firstSeen[cep]; seen {
+			duplicateOf[i] = j
+			continue
+		}
+		firstSeen[cep] = i
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			lookup, err := fetchWeatherForCep(ctx, cep, "")
+			if err != nil {
+				_, codes[i] = lookupErrorCode(err)
+				return
+			}
+			temp := newTemperature(lookup.Cep.City, lookup.Weather.Current.Temperature2M)
+			temp.Approximate = lookup.Approximate
+			temperatures[i] = &temp
+		})
+	}
+	wg.Wait()
+	for i, j := range duplicateOf {
+		temperatures[i], codes[i] = temperatures[j], codes[j]
+	}
+	span.SetAttributes(attribute.Int("batch.duplicates", len(duplicateOf)))
+
+	response := AverageResponse{Results: []AverageResult{}, Failed: []AverageFailure{}}
+	var sum, minC, maxC float64
+	for i, temp := range temperatures {
+		if temp == nil {
+			response.Failed = append(response.Failed, AverageFailure{Index: i, Cep: data.Ceps[i], Code: codes[i], Message: localize(locale, codes[i])})
+			continue
+		}
+		response.Results = append(response.Results, AverageResult{Index: i, Cep: data.Ceps[i], Temperature: *temp})
+		if response.Count == 0 || temp.TempC < minC {
+			minC = temp.TempC
+		}
+		if response.Count == 0 || temp.TempC > maxC {
+			maxC = temp.TempC
+		}
+		sum += temp.TempC
+		response.Count++
+	}
+	if response.Count > 0 {
+		response.Mean = newTemperatureValue(sum / float64(response.Count))
+		response.Min = newTemperatureValue(minC)
+		response.Max = newTemperatureValue(maxC)
+	}
+	span.SetAttributes(attribute.Int("batch.failed", len(response.Failed)))
+
+	writeJSON(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerAverageMalformedVsInvalid(t *testing.T) {
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{body: `not json`, wantStatus: http.StatusBadRequest},
+		{body: `{"ceps":["01001000"`, wantStatus: http.StatusBadRequest},
+		{body: `{"ceps":"01001000"}`, wantStatus: http.StatusUnprocessableEntity},
+		{body: `{"ceps":[]}`, wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		HandlerAverage(rec, httptest.NewRequest(http.MethodPost, "/average", strings.NewReader(tt.body)))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("POST /average %s: status = %d, want %d: %s", tt.body, rec.Code, tt.wantStatus, rec.Body)
+		}
+	}
+}
+
+func TestHandlerAverageRepeatedCeps(t *testing.T) {
+	upstream := newFixtureServer(t, "success")
+
+	body := `{"ceps":["01001000","123","01001000","01001000"]}`
+	rec := httptest.NewRecorder()
+	HandlerAverage(rec, httptest.NewRequest(http.MethodPost, "/average", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got AverageResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	// Every repeat is answered, in its own position, and counts toward the aggregates.
+	var indexes []int
+	for _, result := range got.Results {
+		indexes = append(indexes, result.Index)
+		if result.Cep != "01001000" || result.Temperature.TempC != 21.4 {
+			t.Errorf("result = %+v", result)
+		}
+	}
+	if !slices.Equal(indexes, []int{0, 2, 3}) || got.Count != 3 {
+		t.Errorf("results at %v, count %d, want [0 2 3] and 3", indexes, got.Count)
+	}
+	if len(got.Failed) != 1 || got.Failed[0].Index != 1 || got.Failed[0].Code != codeInvalidZipcode {
+		t.Errorf("failed = %+v, want index 1 %q", got.Failed, codeInvalidZipcode)
+	}
+	if n := upstream.Calls("/json/"); n != 1 {
+		t.Errorf("awesomeapi called %d times, want 1", n)
+	}
+	if n := upstream.Calls("/v1/forecast"); n != 1 {
+		t.Errorf("open-meteo called %d times, want 1", n)
+	}
+}
+
+func TestHandlerAverageKeepsRequestOrder(t *testing.T) {
+	// The first CEP answers last and the last one first.
+	delays := map[string]time.Duration{"01001000": 60 * time.Millisecond, "02002000": 30 * time.Millisecond, "03003000": 0}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/v1/forecast") {
+			http.ServeFile(w, r, "testdata/fixtures/success/openmeteo.json")
+			return
+		}
+		cep := strings.TrimPrefix(r.URL.Path, "/json/")
+		time.Sleep(delays[cep])
+		fmt.Fprintf(w, `{"cep":%q,"state":"SP","lat":"-23.55","lng":"-46.63","city":"City %s"}`, cep, cep)
+	}))
+	t.Cleanup(upstream.Close)
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+	setForTest(t, &openMeteoBaseURL, upstream.URL)
+
+	body := `{"ceps":["01001000","bad","02002000","03003000"]}`
+	rec := httptest.NewRecorder()
+	HandlerAverage(rec, httptest.NewRequest(http.MethodPost, "/average", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got AverageResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	var results []string
+	for _, result := range got.Results {
+		results = append(results, fmt.Sprintf("%d %s %s", result.Index, result.Cep, result.Temperature.City))
+	}
+	want := []string{"0 01001000 City 01001000", "2 02002000 City 02002000", "3 03003000 City 03003000"}
+	if !slices.Equal(results, want) {
+		t.Errorf("results = %q, want %q", results, want)
+	}
+	if len(got.Failed) != 1 || got.Failed[0].Index != 1 {
+		t.Errorf("failed = %+v, want index 1", got.Failed)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type cacheEntry[V any] struct {
+	Value     V
+	Negative  bool
+	ExpiresAt time.Time
+}
+
+// cache is what lookups need from a cache backend. Both backends count their lookups in
+// cache_lookups_total.
+type cache[V any] interface {
+	Get(key string) (cacheEntry[V], bool)
+	// GetStale returns a positive entry that expired no more than maxAge ago, for answering
+	// when the upstream is failing. Live entries are left to Get.
+	GetStale(key string, maxAge time.Duration) (cacheEntry[V], bool)
+	Set(key string, value V, ttl time.Duration)
+	SetNegative(key string, ttl time.Duration)
+}
+
+// newCache returns a cache on the backend picked by CACHE_BACKEND. A misconfigured Redis
+// backend falls back to memory rather than keeping the service from starting.
+func newCache[V any](name string) cache[V] {
+	switch cacheBackend {
+	case "redis":
+		client, err := newRedisClient(redisURL, redisTimeout, redisPoolSize)
+		if err == nil {
+			metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "redis_pool_idle_connections",
+				Help:        "Idle Redis connections kept in the cache's pool.",
+				ConstLabels: prometheus.Labels{"cache": labelValue("cache", name)},
+			}, func() float64 { return float64(len(client.pool)) })
+			return newRedisCache[V](name, client)
+		}
+		log.Printf("invalid REDIS_URL (%s), using in-memory %s cache", err, name)
+	case "memory":
+	default:
+		log.Printf("unknown cache backend %q, using memory", cacheBackend)
+	}
+	return newTTLCache[V](name, cacheMaxEntries)
+}
+
+// ttlCache is a bounded in-memory cache whose entries expire after a per-entry TTL. A negative
+// entry records that the key is known not to exist upstream.
+type ttlCache[V any] struct {
+	name       string
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[V]
+}
+
+func newTTLCache[V any](name string, maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{
+		name:       name,
+		maxEntries: maxEntries,
+		entries:    make(map[string]cacheEntry[V]),
+	}
+}
+
+// Get returns the live entry for key, if any.
+func (c *ttlCache[V]) Get(key string) (cacheEntry[V], bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	switch {
+	case !ok || time.Now().After(entry.ExpiresAt):
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "miss").Inc()
+		return cacheEntry[V]{}, false
+	case entry.Negative:
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "negative_hit").Inc()
+	default:
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "hit").Inc()
+	}
+	return entry, true
+}
+
+func (c *ttlCache[V]) GetStale(key string, maxAge time.Duration) (cacheEntry[V], bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if !ok || entry.Negative || !isStale(entry.ExpiresAt, maxAge) {
+		return cacheEntry[V]{}, false
+	}
+	cacheLookups.WithLabelValues(labelValue("cache", c.name), "stale_hit").Inc()
+	return entry, true
+}
+
+// isStale reports whether expiresAt has passed, but by no more than maxAge.
+func isStale(expiresAt time.Time, maxAge time.Duration) bool {
+	age := time.Since(expiresAt)
+	return age > 0 && age <= maxAge
+}
+
+func (c *ttlCache[V]) Set(key string, value V, ttl time.Duration) {
+	c.store(key, cacheEntry[V]{Value: value, ExpiresAt: time.Now().Add(jitterTTL(ttl, cacheTTLJitter))})
+}
+
+func (c *ttlCache[V]) SetNegative(key string, ttl time.Duration) {
+	c.store(key, cacheEntry[V]{Negative: true, ExpiresAt: time.Now().Add(jitterTTL(ttl, cacheTTLJitter))})
+}
+
+// cacheBypassBaggageKey is the W3C baggage member that, with ALLOW_DEBUG_BAGGAGE, makes a
+// request skip every cache read, for debugging caching in production without a deploy.
+const cacheBypassBaggageKey = "cache-bypass"
+
+// cacheBypassed reports whether the request in ctx asked to skip the caches with
+// cache-bypass=true. Only a request whose span is recorded may, so every bypass shows up in
+// a trace; with tracing disabled the member is ignored. Each bypassed read adds a
+// cache.bypass event to the span.
+func cacheBypassed(ctx context.Context, name, key string) bool {
+	if !allowDebugBaggage || baggage.FromContext(ctx).Member(cacheBypassBaggageKey).Value() != "true" {
+		return false
+	}
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsSampled() {
+		return false
+	}
+	span.AddEvent("cache.bypass", trace.WithAttributes(stringAttr("cache.name", name), stringAttr("cache.key", key)))
+	return true
+}
+
+// cacheGet is c.Get(key), except that a request bypassing the caches always misses.
+func cacheGet[V any](ctx context.Context, c cache[V], name, key string) (cacheEntry[V], bool) {
+	if cacheBypassed(ctx, name, key) {
+		return cacheEntry[V]{}, false
+	}
+	return c.Get(key)
+}
+
+// traceCacheLookup adds a cache.hit or cache.miss event, with the cache name and key, to the
+// span in ctx, so a trace shows whether the request was answered from the cache.
+func traceCacheLookup(ctx context.Context, name, key string, hit, negative bool) {
+	event := "cache.miss"
+	if hit {
+		event = "cache.hit"
+	}
+	trace.SpanFromContext(ctx).AddEvent(event, trace.WithAttributes(
+		stringAttr("cache.name", name),
+		stringAttr("cache.key", key),
+		attribute.Bool("cache.negative", negative),
+	))
+}
+
+// jitterTTL spreads ttl uniformly over ±fraction of itself, so entries written together
+// (e.g. during a warmup) don't all expire in the same instant and stampede the upstream.
+func jitterTTL(ttl time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return ttl
+	}
+	offset := (rand.Float64()*2 - 1) * fraction * float64(ttl)
+	return ttl + time.Duration(offset)
+}
+
+func (c *ttlCache[V]) store(key string, entry cacheEntry[V]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = entry
+}
+
+// snapshot copies the live entries, for exporting them.
+func (c *ttlCache[V]) snapshot() map[string]cacheEntry[V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	live := make(map[string]cacheEntry[V], len(c.entries))
+	for key, entry := range c.entries {
+		if now.Before(entry.ExpiresAt) {
+			live[key] = entry
+		}
+	}
+	return live
+}
+
+// restore stores an imported entry as is, unless the cache already has one for key that
+// stays fresh longer. It reports whether the entry was stored.
+func (c *ttlCache[V]) restore(key string, entry cacheEntry[V]) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, exists := c.entries[key]
+	if exists && !existing.ExpiresAt.Before(entry.ExpiresAt) {
+		return false
+	}
+	if !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = entry
+	return true
+}
+
+// evictLocked drops expired entries and, if the cache is still full, an arbitrary one.
+func (c *ttlCache[V]) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.ExpiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterTTLStaysWithinBand(t *testing.T) {
+	const ttl = time.Hour
+	for _, fraction := range []float64{0, 0.1, 0.5, 1} {
+		band := time.Duration(fraction * float64(ttl))
+		lowest, highest := ttl, ttl
+		for range 2000 {
+			got := jitterTTL(ttl, fraction)
+			if got < ttl-band || got > ttl+band {
+				t.Fatalf("jitterTTL(%s, %v) = %s, outside %s..%s", ttl, fraction, got, ttl-band, ttl+band)
+			}
+			lowest, highest = min(lowest, got), max(highest, got)
+		}
+		// The spread should actually use the band, not sit at ttl.
+		if fraction > 0 && (highest-lowest) < band {
+			t.Errorf("jitterTTL(%s, %v) only spread over %s in 2000 draws, want most of %s", ttl, fraction, highest-lowest, 2*band)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// CacheDump is the body of GET /admin/cache/export and POST /admin/cache/import: the live
+// entries of each in-memory cache, by cache name.
+type CacheDump struct {
+	ExportedAt jsonTime                    `json:"exported_at"`
+	Caches     map[string][]CacheDumpEntry `json:"caches"`
+}
+
+// CacheDumpEntry is one cache entry. TTL is how long it had left when exported; an import
+// keeps it only that long, so an entry never outlives the freshness it was cached with.
+type CacheDumpEntry struct {
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Negative bool            `json:"negative,omitempty"`
+	TTL      jsonDuration    `json:"ttl"`
+}
+
+// CacheImportResult counts, per cache, the entries an import stored. Skipped are those that
+// had no TTL left or were older than what the cache already held.
+type CacheImportResult struct {
+	Imported map[string]int `json:"imported"`
+	Skipped  int            `json:"skipped"`
+}
+
+// cacheTransfer exports and imports one cache's entries as CacheDumpEntry. load decodes
+// entries without storing them and returns the function that stores them, which reports how
+// many it kept.
+type cacheTransfer struct {
+	export func() []CacheDumpEntry
+	load   func(entries []CacheDumpEntry) (store func() int, err error)
+}
+
+// transferableCaches are the caches a warm start can carry over. Only in-memory caches take
+// part: with CACHE_BACKEND=redis the cache is shared and outlives any one instance already.
+var transferableCaches = newTransferableCaches()
+
+func newTransferableCaches() map[string]cacheTransfer {
+	caches := make(map[string]cacheTransfer)
+	addCacheTransfer(caches, "cep", cepCache)
+	addCacheTransfer(caches, "cep_location", cepLocationCache)
+	addCacheTransfer(caches, "geocode", geocodeCache)
+	addCacheTransfer(caches, "weather", weatherCache)
+	return caches
+}
+
+func addCacheTransfer[V any](caches map[string]cacheTransfer, name string, c cache[V]) {
+	mem, ok := c.(*ttlCache[V])
+	if !ok {
+		return
+	}
+	caches[name] = cacheTransfer{
+		export: func() []CacheDumpEntry {
+			now := time.Now()
+			entries := []CacheDumpEntry{}
+			for key, entry := range mem.snapshot() {
+				dumped := CacheDumpEntry{Key: key, Negative: entry.Negative, TTL: jsonDuration(entry.ExpiresAt.Sub(now))}
+				if !entry.Negative {
+					value, err := json.Marshal(entry.Value)
+					if err != nil {
+						continue
+					}
+					dumped.Value = value
+				}
+				entries = append(entries, dumped)
+			}
+			slices.SortFunc(entries, func(a, b CacheDumpEntry) int { return cmp.Compare(a.Key, b.Key) })
+			return entries
+		},
+		load: func(entries []CacheDumpEntry) (func() int, error) {
+			decoded, err := decodeCacheDump[V](name, entries)
+			if err != nil {
+				return nil, err
+			}
+			return func() int {
+				stored := 0
+				now := time.Now()
+				for i, entry := range decoded {
+					if entries[i].TTL <= 0 {
+						continue
+					}
+					entry.ExpiresAt = now.Add(time.Duration(entries[i].TTL))
+					if mem.restore(entries[i].Key, entry) {
+						stored++
+					}
+				}
+				return stored
+			}, nil
+		},
+	}
+}
+
+func decodeCacheDump[V any](name string, entries []CacheDumpEntry) ([]cacheEntry[V], error) {
+	decoded := make([]cacheEntry[V], len(entries))
+	for i, entry := range entries {
+		if entry.Key == "" {
+			return nil, fmt.Errorf("%s[%d]: key is required", name, i)
+		}
+		decoded[i].Negative = entry.Negative
+		if entry.Negative {
+			continue
+		}
+		if len(entry.Value) == 0 {
+			return nil, fmt.Errorf("%s[%d]: value is required unless negative", name, i)
+		}
+		if err := json.Unmarshal(entry.Value, &decoded[i].Value); err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", name, i, err)
+		}
+	}
+	return decoded, nil
+}
+
+// HandlerExportCache dumps the live entries of every in-memory cache, for POST
+// /admin/cache/import on another instance.
+func HandlerExportCache(w http.ResponseWriter, r *http.Request) {
+	dump := CacheDump{ExportedAt: jsonTime(time.Now()), Caches: make(map[string][]CacheDumpEntry)}
+	for name, transfer := range transferableCaches {
+		dump.Caches[name] = transfer.export()
+	}
+	writeJSON(w, r, http.StatusOK, dump)
+}
+
+// HandlerImportCache loads a CacheDump. The whole dump is checked before anything is stored,
+// so a malformed one changes nothing.
+func HandlerImportCache(w http.ResponseWriter, r *http.Request) {
+	// exported_at is informational; only the caches are read back.
+	var dump struct {
+		Caches map[string][]CacheDumpEntry `json:"caches"`
+	}
+	// A full dump of every cache can be several megabytes.
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&dump); err != nil {
+		writeErrorDetail(w, r, decodeErrorStatus(err), codeInvalidPayload, err.Error())
+		return
+	}
+	stores := make(map[string]func() int, len(dump.Caches))
+	for name, entries := range dump.Caches {
+		transfer, ok := transferableCaches[name]
+		if !ok {
+			writeErrorDetail(w, r, http.StatusUnprocessableEntity, codeInvalidPayload, fmt.Sprintf("unknown or non-local cache %q", name))
+			return
+		}
+		store, err := transfer.load(entries)
+		if err != nil {
+			writeErrorDetail(w, r, http.StatusUnprocessableEntity, codeInvalidPayload, err.Error())
+			return
+		}
+		stores[name] = store
+	}
+
+	result := CacheImportResult{Imported: make(map[string]int)}
+	for name, store := range stores {
+		stored := store()
+		result.Imported[name] = stored
+		result.Skipped += len(dump.Caches[name]) - stored
+	}
+	writeJSON(w, r, http.StatusOK, result)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+
+	"github.com/adrianodevfullstack/lab02.git/cep"
+)
+
+// cepParser accepts the standard CEP formats or, with CEP_VALIDATION_REGEX, whatever that
+// pattern matches instead. A pattern that doesn't compile stops the service at startup.
+var cepParser = newCepParser(envString("CEP_VALIDATION_REGEX", ""))
+
+func newCepParser(pattern string) *cep.Parser {
+	parser, err := cep.NewParser(padCep, pattern)
+	if err != nil {
+		log.Fatalf("invalid CEP_VALIDATION_REGEX %q: %s", pattern, err)
+	}
+	return parser
+}
+
+// parseCep returns the CEP raw stands for, or a *cep.InvalidError saying why there is none.
+func parseCep(raw string) (string, error) {
+	return cepParser.Parse(raw)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCepRateLimited means the CEP already used up its upstream calls for the interval.
+var errCepRateLimited = errors.New("cep upstream calls rate limited")
+
+// cepCallLimiter allows each key at most limit calls per fixed interval window. Windows are
+// kept per key and dropped once they have ended.
+type cepCallLimiter struct {
+	limit    int
+	interval time.Duration
+
+	mu        sync.Mutex
+	windows   map[string]cepWindow
+	lastPrune time.Time
+}
+
+type cepWindow struct {
+	start time.Time
+	calls int
+}
+
+func newCepCallLimiter(limit int, interval time.Duration) *cepCallLimiter {
+	return &cepCallLimiter{limit: limit, interval: interval, windows: make(map[string]cepWindow)}
+}
+
+// Allow reports whether key may make another call now, counting it if so.
+func (l *cepCallLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= l.interval {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= l.interval {
+				delete(l.windows, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.interval {
+		w = cepWindow{start: now}
+	}
+	if w.calls >= l.limit {
+		return false
+	}
+	w.calls++
+	l.windows[key] = w
+	return true
+}
+
+// cepFlightGroup collapses concurrent upstream lookups of the same CEP into one, so a burst of
+// misses for a hot CEP costs a single provider walk and the rest wait for its result.
+type cepFlightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*cepFlight
+}
+
+type cepFlight struct {
+	done   chan struct{}
+	result *CepAwesomeapiResponse
+	source dataSource
+	err    error
+}
+
+// Do runs lookup for cep unless one is already running, in which case it waits for that one.
+// lookup runs detached from ctx's cancellation, since other callers may be waiting on it; ctx
+// only bounds how long this caller waits.
+func (g *cepFlightGroup) Do(ctx context.Context, cep string, lookup func(ctx context.Context) (*CepAwesomeapiResponse, dataSource, error)) (*CepAwesomeapiResponse, dataSource, error) {
+	g.mu.Lock()
+	f, running := g.flights[cep]
+	if !running {
+		f = &cepFlight{done: make(chan struct{})}
+		if g.flights == nil {
+			g.flights = make(map[string]*cepFlight)
+		}
+		g.flights[cep] = f
+	}
+	g.mu.Unlock()
+
+	if !running {
+		go func() {
+			f.result, f.source, f.err = lookup(context.WithoutCancel(ctx))
+			g.mu.Lock()
+			delete(g.flights, cep)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+
+	select {
+	case <-f.done:
+		if f.result == nil {
+			return nil, f.source, f.err
+		}
+		// Each caller gets its own copy, as it would from the cache.
+		result := *f.result
+		return &result, f.source, f.err
+	case <-ctx.Done():
+		return nil, sourceNone, ctx.Err()
+	}
+}
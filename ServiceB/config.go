@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/tls"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// padCep restores the leading zero spreadsheets tend to drop (1001000 -> 01001000).
+	padCep = envBool("PAD_CEP", false)
+
+	requestTimeout    = envDuration("REQUEST_TIMEOUT", 60*time.Second)
+	maxRequestTimeout = envDuration("MAX_REQUEST_TIMEOUT", 5*time.Minute)
+	shutdownTimeout   = envDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	traceFlushTimeout = envDuration("TRACE_FLUSH_TIMEOUT", 5*time.Second)
+
+	// shutdownDrainDelay keeps the listener open this long after a shutdown signal, answering
+	// new requests with 503 so load balancers stop routing here before connections are refused.
+	shutdownDrainDelay = envDuration("SHUTDOWN_DRAIN_DELAY", 0)
+
+	// shutdownSignals start the graceful shutdown. Container platforms stop with SIGTERM.
+	shutdownSignals = envSignals("SHUTDOWN_SIGNALS", []os.Signal{os.Interrupt, syscall.SIGTERM})
+
+	// tracingRequired makes a failed tracing setup fatal instead of starting without tracing.
+	tracingRequired = envBool("TRACING_REQUIRED", false)
+
+	// collectorEndpoints are the OTLP gRPC collectors spans are exported to, the first
+	// preferred and the others failed over to in order while it can't be reached.
+	collectorEndpoints = envList("OTEL_EXPORTER_OTLP_ENDPOINTS", []string{"otel-collector:4317"})
+
+	// syncSpans exports each span as it ends instead of in batches, so a single test request
+	// shows up in Jaeger right away. Every span end then waits on the collector: debug only.
+	syncSpans = envBool("SYNC_SPANS", false)
+
+	// spanAttributeMaxLength bounds string span attributes, which may carry upstream data.
+	spanAttributeMaxLength = envInt("SPAN_ATTRIBUTE_MAX_LENGTH", 256)
+
+	loadShedHighWater = envInt("LOAD_SHED_HIGH_WATER", 1000)
+
+	// GET /status reports dependency checks run in the background on this schedule.
+	statusCheckInterval = envDuration("STATUS_CHECK_INTERVAL", 30*time.Second)
+	statusCheckTimeout  = envDuration("STATUS_CHECK_TIMEOUT", 5*time.Second)
+
+	// metricsAuthToken protects /metrics when set; unset keeps it open for trusted networks.
+	metricsAuthToken = os.Getenv("METRICS_AUTH_TOKEN")
+	// adminToken enables the /admin endpoints; without it they are not mounted at all.
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// defaultLocale is used for error messages when Accept-Language names no supported language.
+	defaultLocale = envString("DEFAULT_LOCALE", "pt-BR")
+
+	// responseHeaders are set on every response. RESPONSE_HEADERS adds to or overrides the
+	// security defaults; an entry with an empty value removes a default.
+	responseHeaders = envHeaders("RESPONSE_HEADERS", map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+	})
+
+	// timeFormat is how timestamps in responses are serialized: "rfc3339" or "unix".
+	timeFormat = envString("TIME_FORMAT", timeFormatRFC3339)
+
+	// errorFormat is the shape of error bodies: "simple" (ErrorResponse) or "problem"
+	// (RFC 7807 application/problem+json), whose type URIs start with problemTypeBaseURI.
+	errorFormat        = envString("ERROR_FORMAT", errorFormatSimple)
+	problemTypeBaseURI = envString("PROBLEM_TYPE_BASE_URI", "urn:lab02:error:")
+
+	// responseEnvelope wraps successful temperature responses as {"data": ..., "meta": ...}
+	// for gateways that expect every payload in that shape.
+	responseEnvelope = envBool("RESPONSE_ENVELOPE", false)
+
+	// requestIDHeader carries the request ID in and, from ServiceA, on to ServiceB.
+	requestIDHeader = envString("REQUEST_ID_HEADER", "X-Request-ID")
+
+	// strictQueryParams rejects query parameters a route doesn't read with 422, instead of
+	// ignoring them, so clients notice typos.
+	strictQueryParams = envBool("STRICT_QUERY_PARAMS", false)
+
+	// canonicalRedirect sends GET /01001-000 to /01001000 with a 301, so a CDN caches one key per CEP.
+	canonicalRedirect = envBool("CANONICAL_REDIRECT", false)
+
+	// weatherCurrentVars are extra open-meteo "current" variables fetched for every lookup and
+	// returned under "current"; names outside knownWeatherVars are skipped.
+	weatherCurrentVars = newWeatherCurrentVars(envList("WEATHER_CURRENT_VARS", nil))
+
+	// debugEndpoints unlocks debugging aids that must never reach normal clients.
+	debugEndpoints = envBool("DEBUG_ENDPOINTS", false)
+
+	// allowDebugBaggage honors the cache-bypass=true baggage member on sampled traces, so a
+	// debug session can see what the upstreams answer right now. Off, the member is ignored.
+	allowDebugBaggage = envBool("ALLOW_DEBUG_BAGGAGE", false)
+
+	// debugMaxDelay caps the ?delay= a debug deployment accepts for simulating a slow ServiceB.
+	debugMaxDelay = envDuration("DEBUG_MAX_DELAY", 5*time.Second)
+
+	// weatherEnabled=false turns ServiceB into a CEP-to-address service: GET /{cep} answers with
+	// the address and nothing calls a weather provider.
+	weatherEnabled = envBool("WEATHER_ENABLED", true)
+
+	// weatherCoverageCheck rejects coordinates open-meteo has no current data for instead of
+	// reporting the zero value as 0°C.
+	weatherCoverageCheck = envBool("WEATHER_COVERAGE_CHECK", false)
+
+	upstreamTimeout       = envDuration("UPSTREAM_TIMEOUT", 10*time.Second)
+	dialTimeout           = envDuration("DIAL_TIMEOUT", 3*time.Second)
+	tlsHandshakeTimeout   = envDuration("TLS_HANDSHAKE_TIMEOUT", 5*time.Second)
+	responseHeaderTimeout = envDuration("RESPONSE_HEADER_TIMEOUT", 10*time.Second)
+	maxUpstreamBodyBytes  = envInt("MAX_UPSTREAM_BODY_BYTES", 1<<20)
+	minTLSVersion         = envTLSVersion("MIN_TLS_VERSION", tls.VersionTLS12)
+	upstreamProxyURL      = envString("UPSTREAM_PROXY_URL", "")
+
+	// upstreamRetries is how many more times a GET that got one of retryableStatusCodes is
+	// tried, upstreamRetryBackoff apart and doubling. Unset means no retries; 4xx codes are
+	// only retried when listed explicitly.
+	upstreamRetries      = envInt("UPSTREAM_RETRIES", 0)
+	upstreamRetryBackoff = envDuration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond)
+	retryableStatusCodes = envStatusCodes("RETRYABLE_STATUS_CODES", []int{502, 503, 504})
+
+	// With upstreamMaxConcurrency set, at most that many upstream calls are in flight, at most
+	// upstreamTenantMaxConcurrency of them for one tenant (W3C baggage "tenant"), and waiting
+	// tenants are served in turn. Unset means no limit.
+	upstreamMaxConcurrency       = envInt("UPSTREAM_MAX_CONCURRENCY", 0)
+	upstreamTenantMaxConcurrency = envInt("UPSTREAM_TENANT_MAX_CONCURRENCY", 0)
+
+	// Per-call limits for the CEP and weather provider chains, each defaulting to UPSTREAM_TIMEOUT.
+	cepAPITimeout     = envDuration("CEP_API_TIMEOUT", upstreamTimeout)
+	weatherAPITimeout = envDuration("WEATHER_API_TIMEOUT", upstreamTimeout)
+
+	// With adaptiveTimeoutEnabled, each provider's timeout follows a percentile of its recent
+	// latencies, between the floor and its CEP_API_TIMEOUT/WEATHER_API_TIMEOUT.
+	adaptiveTimeoutEnabled    = envBool("ADAPTIVE_TIMEOUT", false)
+	adaptiveTimeoutPercentile = envFraction("ADAPTIVE_TIMEOUT_PERCENTILE", 0.99)
+	adaptiveTimeoutFloor      = envDuration("ADAPTIVE_TIMEOUT_FLOOR", 500*time.Millisecond)
+
+	// Base URLs of the upstreams, overridable to point at a stub or recorded fixtures.
+	awesomeapiBaseURL       = baseURL("AWESOMEAPI_BASE_URL", "https://cep.awesomeapi.com.br")
+	viacepBaseURL           = baseURL("VIACEP_BASE_URL", "https://viacep.com.br")
+	openMeteoBaseURL        = baseURL("OPENMETEO_BASE_URL", "https://api.open-meteo.com")
+	openMeteoGeocodeBaseURL = baseURL("OPENMETEO_GEOCODING_BASE_URL", "https://geocoding-api.open-meteo.com")
+	nominatimBaseURL        = baseURL("NOMINATIM_BASE_URL", "https://nominatim.openstreetmap.org")
+	openWeatherMapBaseURL   = baseURL("OPENWEATHERMAP_BASE_URL", "https://api.openweathermap.org")
+	ibgeBaseURL             = baseURL("IBGE_BASE_URL", "https://servicodados.ibge.gov.br")
+
+	// openMeteoArchiveBaseURL serves the history behind GET /{cep}/stats, capped at statsMaxDays.
+	openMeteoArchiveBaseURL = baseURL("OPENMETEO_ARCHIVE_BASE_URL", "https://archive-api.open-meteo.com")
+	statsMaxDays            = envInt("STATS_MAX_DAYS", 366)
+
+	// forecastMaxDays caps ?days= on GET /{cep}/forecast; open-meteo forecasts at most 16.
+	forecastMaxDays = envInt("FORECAST_MAX_DAYS", 16)
+
+	// POST /admin/warmup limits: CEPs per job and lookups in flight per job.
+	warmupMaxCeps     = envInt("WARMUP_MAX_CEPS", 10000)
+	warmupConcurrency = envInt("WARMUP_CONCURRENCY", 4)
+
+	// cacheBackend is "memory" (per instance) or "redis" (shared between instances).
+	cacheBackend    = envString("CACHE_BACKEND", "memory")
+	cacheMaxEntries = envInt("CACHE_MAX_ENTRIES", 10000)
+	geocodeCacheTTL = envDuration("GEOCODE_CACHE_TTL", 30*24*time.Hour)
+	redisURL        = envString("REDIS_URL", "redis://localhost:6379/0")
+	redisTimeout    = envDuration("REDIS_TIMEOUT", 200*time.Millisecond)
+	redisPoolSize   = envInt("REDIS_POOL_SIZE", 16)
+	// Cities the geocoder can't resolve are remembered briefly, in their own LRU of at most
+	// this many entries.
+	geocodeNegativeCacheTTL        = envDuration("GEOCODE_NEGATIVE_CACHE_TTL", 10*time.Minute)
+	geocodeNegativeCacheMaxEntries = envInt("GEOCODE_NEGATIVE_CACHE_MAX_ENTRIES", 1000)
+	// cepLocationCacheTTL keeps a CEP's coordinates and city, which practically never change,
+	// long after the full address (CEP_CACHE_TTL) has expired.
+	cepLocationCacheTTL = envDuration("CEP_LOCATION_CACHE_TTL", 30*24*time.Hour)
+	// cepRateLimit caps the provider walks a single CEP may cause per cepRateLimitInterval, to
+	// keep a hot CEP that doesn't stay cached from hammering the providers. Unset means no cap.
+	cepRateLimit         = envInt("CEP_RATE_LIMIT", 0)
+	cepRateLimitInterval = envDuration("CEP_RATE_LIMIT_INTERVAL", time.Minute)
+	// weatherCacheTTL is how long current conditions are reused for the same coordinates;
+	// open-meteo refreshes them every 15 minutes.
+	weatherCacheTTL = envDuration("WEATHER_CACHE_TTL", 5*time.Minute)
+	// weatherPrefetch warms the weather cache in the background when an address is served from
+	// the cache, with at most weatherPrefetchConcurrency prefetches at a time.
+	weatherPrefetch            = envBool("WEATHER_PREFETCH", false)
+	weatherPrefetchConcurrency = envInt("WEATHER_PREFETCH_CONCURRENCY", 4)
+	// serveStale answers with an expired CEP cache entry when every provider fails, as long as
+	// it expired less than maxStaleAge ago; older data is too misleading and the error is returned.
+	serveStale  = envBool("SERVE_STALE", false)
+	maxStaleAge = envDuration("MAX_STALE_AGE", time.Hour)
+	// cacheTTLJitter is the fraction (0.1 = ±10%) by which cache TTLs are randomized.
+	cacheTTLJitter = envFraction("CACHE_TTL_JITTER", 0.1)
+
+	// The geocoder gets at most geocoderRateLimit requests per second, 0 meaning its usage
+	// policy's limit if it has one, and geocoderMaxConcurrency in flight.
+	geocoderRateLimit      = envFloat("GEOCODER_RATE_LIMIT", 0)
+	geocoderMaxConcurrency = envInt("GEOCODER_MAX_CONCURRENCY", 4)
+
+	// Nominatim's usage policy asks for a User-Agent that identifies the application.
+	nominatimUserAgent = envString("NOMINATIM_USER_AGENT", "lab02-serviceb (+https://github.com/adrianodevfullstack/lab02)")
+
+	breakerFailureThreshold = envInt("BREAKER_FAILURE_THRESHOLD", 5)
+	breakerCooldown         = envDuration("BREAKER_COOLDOWN", 30*time.Second)
+
+	openWeatherMapAPIKey = os.Getenv("OPENWEATHERMAP_API_KEY")
+)
+
+// runtimeConfig starts from the environment and can be tuned later through /admin/config.
+var runtimeConfig = newConfigStore(RuntimeConfig{
+	CepCacheTTL:            jsonDuration(envDuration("CEP_CACHE_TTL", 24*time.Hour)),
+	NegativeCacheTTL:       jsonDuration(envDuration("NEGATIVE_CACHE_TTL", 5*time.Minute)),
+	AverageMaxCeps:         envInt("AVERAGE_MAX_CEPS", 50),
+	AverageConcurrency:     envInt("AVERAGE_CONCURRENCY", 8),
+	UpstreamRetries:        upstreamRetries,
+	UpstreamMaxConcurrency: upstreamMaxConcurrency,
+})
+
+func envString(key, fallback string) string {
+	if value := setting(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(setting(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(setting(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(setting(key), 64)
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// envFraction is envFloat limited to 0..1, the range CONFIG_FILE enforces for the same
+// settings. A value outside it falls back rather than, say, letting a jitter of 2 produce
+// negative TTLs.
+func envFraction(key string, fallback float64) float64 {
+	value := envFloat(key, fallback)
+	if value > 1 {
+		return fallback
+	}
+	return value
+}
+
+// baseURL is envString without a trailing slash, so paths can be appended as they are.
+func baseURL(key, fallback string) string {
+	return strings.TrimSuffix(envString(key, fallback), "/")
+}
+
+// envList reads a comma-separated list, dropping blank items.
+func envList(key string, fallback []string) []string {
+	var items []string
+	for _, item := range strings.Split(setting(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return fallback
+	}
+	return items
+}
+
+// envTLSVersion accepts "1.2" or "1.3"; anything else, including older versions, falls back.
+func envTLSVersion(key string, fallback uint16) uint16 {
+	switch setting(key) {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	return fallback
+}
+
+// envHeaders parses "Name=value;Other=value" over defaults. Malformed entries are skipped.
+func envHeaders(key string, defaults map[string]string) http.Header {
+	values := maps.Clone(defaults)
+	for _, entry := range strings.Split(setting(key), ";") {
+		name, value, ok := strings.Cut(entry, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			continue
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+
+	headers := make(http.Header)
+	for name, value := range values {
+		if value != "" {
+			headers.Set(name, value)
+		}
+	}
+	return headers
+}
+
+// signalsByName are the signals SHUTDOWN_SIGNALS may name, with or without the SIG prefix.
+var signalsByName = map[string]os.Signal{
+	"SIGINT":  os.Interrupt,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// envSignals reads a comma-separated list of signal names. Unknown names are skipped.
+func envSignals(key string, fallback []os.Signal) []os.Signal {
+	var signals []os.Signal
+	for _, name := range envList(key, nil) {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		if sig, ok := signalsByName[name]; ok {
+			signals = append(signals, sig)
+		}
+	}
+	if len(signals) == 0 {
+		return fallback
+	}
+	return signals
+}
+
+// envStatusCodes reads a comma-separated list of HTTP status codes as a set, skipping items
+// that aren't one.
+func envStatusCodes(key string, fallback []int) map[int]bool {
+	codes := make(map[int]bool)
+	for _, item := range envList(key, nil) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			continue
+		}
+		codes[code] = true
+	}
+	if len(codes) == 0 {
+		for _, code := range fallback {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(setting(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
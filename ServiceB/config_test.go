@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestEnvFraction(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{value: "", want: 0.1},
+		{value: "0", want: 0},
+		{value: "0.25", want: 0.25},
+		{value: "1", want: 1},
+		{value: "1.5", want: 0.1},
+		{value: "-0.2", want: 0.1},
+		{value: "ten percent", want: 0.1},
+	}
+	for _, tt := range tests {
+		t.Setenv("CACHE_TTL_JITTER", tt.value)
+		if got := envFraction("CACHE_TTL_JITTER", 0.1); got != tt.want {
+			t.Errorf("CACHE_TTL_JITTER=%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestEnvStatusCodes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{value: "", want: []int{502, 503, 504}},
+		{value: "520,521, 522", want: []int{520, 521, 522}},
+		{value: "503,abc,999,42", want: []int{503}},
+		{value: "abc", want: []int{502, 503, 504}},
+	}
+	for _, tt := range tests {
+		t.Setenv("RETRYABLE_STATUS_CODES", tt.value)
+		got := envStatusCodes("RETRYABLE_STATUS_CODES", []int{502, 503, 504})
+		if len(got) != len(tt.want) {
+			t.Errorf("RETRYABLE_STATUS_CODES=%q: got %v, want %v", tt.value, got, tt.want)
+			continue
+		}
+		for _, code := range tt.want {
+			if !got[code] {
+				t.Errorf("RETRYABLE_STATUS_CODES=%q: got %v, want %v", tt.value, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// fileConfig is the layout of CONFIG_FILE, in YAML or JSON. Each setting stands for the
+// environment variable named next to it in settings, and that variable wins when both are set.
+type fileConfig struct {
+	CepProviders     []string `yaml:"cep_providers"`
+	WeatherProviders []string `yaml:"weather_providers"`
+	Geocoder         string   `yaml:"geocoder"`
+
+	Timeouts fileTimeouts `yaml:"timeouts"`
+	Cache    fileCache    `yaml:"cache"`
+	Breaker  fileBreaker  `yaml:"breaker"`
+	Retries  fileRetries  `yaml:"retries"`
+}
+
+type fileTimeouts struct {
+	Request        string `yaml:"request"`
+	Upstream       string `yaml:"upstream"`
+	CepAPI         string `yaml:"cep_api"`
+	WeatherAPI     string `yaml:"weather_api"`
+	Dial           string `yaml:"dial"`
+	TLSHandshake   string `yaml:"tls_handshake"`
+	ResponseHeader string `yaml:"response_header"`
+
+	Adaptive fileAdaptiveTimeout `yaml:"adaptive"`
+}
+
+type fileAdaptiveTimeout struct {
+	Enabled    *bool    `yaml:"enabled"`
+	Percentile *float64 `yaml:"percentile"`
+	Floor      string   `yaml:"floor"`
+}
+
+type fileCache struct {
+	Backend        string   `yaml:"backend"`
+	MaxEntries     *int     `yaml:"max_entries"`
+	CepTTL         string   `yaml:"cep_ttl"`
+	NegativeTTL    string   `yaml:"negative_ttl"`
+	CepLocationTTL string   `yaml:"cep_location_ttl"`
+	GeocodeTTL     string   `yaml:"geocode_ttl"`
+	WeatherTTL     string   `yaml:"weather_ttl"`
+	TTLJitter      *float64 `yaml:"ttl_jitter"`
+	ServeStale     *bool    `yaml:"serve_stale"`
+	MaxStaleAge    string   `yaml:"max_stale_age"`
+}
+
+type fileBreaker struct {
+	FailureThreshold *int   `yaml:"failure_threshold"`
+	Cooldown         string `yaml:"cooldown"`
+}
+
+type fileRetries struct {
+	Count       *int   `yaml:"count"`
+	Backoff     string `yaml:"backoff"`
+	StatusCodes []int  `yaml:"status_codes"`
+}
+
+// configFile holds the settings read from CONFIG_FILE by environment variable name, for
+// setting to fall back on. configFileErr is reported by main, which refuses to start.
+var configFile, configFileErr = loadConfigFile(os.Getenv("CONFIG_FILE"))
+
+// setting is the value of the environment variable key or, when it is unset or empty, the
+// value CONFIG_FILE gives it.
+func setting(key string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return configFile[key]
+}
+
+// loadConfigFile reads and validates the config file at path; an empty path means none.
+// Unknown keys, malformed values and unknown provider names are errors rather than skipped,
+// since a typo in a file is never intended.
+func loadConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	settings, err := cfg.settings()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// settings flattens cfg into environment variable names and values, validating each.
+func (cfg *fileConfig) settings() (map[string]string, error) {
+	settings := make(map[string]string)
+
+	lists := []struct {
+		path, key string
+		value     []string
+		known     map[string]bool
+	}{
+		{"cep_providers", "CEP_PROVIDERS", cfg.CepProviders, knownCepProviderNames()},
+		{"weather_providers", "WEATHER_PROVIDERS", cfg.WeatherProviders, setOf("openmeteo", "openweathermap")},
+	}
+	for _, l := range lists {
+		for _, name := range l.value {
+			if !l.known[name] {
+				return nil, fmt.Errorf("%s: unknown provider %q", l.path, name)
+			}
+		}
+		if len(l.value) > 0 {
+			settings[l.key] = strings.Join(l.value, ",")
+		}
+	}
+
+	choices := []struct {
+		path, key, value string
+		known            map[string]bool
+	}{
+		{"geocoder", "GEOCODER", cfg.Geocoder, setOf("openmeteo", "nominatim")},
+		{"cache.backend", "CACHE_BACKEND", cfg.Cache.Backend, setOf("memory", "redis")},
+	}
+	for _, c := range choices {
+		if c.value == "" {
+			continue
+		}
+		if !c.known[c.value] {
+			return nil, fmt.Errorf("%s: unknown value %q", c.path, c.value)
+		}
+		settings[c.key] = c.value
+	}
+
+	durations := []struct{ path, key, value string }{
+		{"timeouts.request", "REQUEST_TIMEOUT", cfg.Timeouts.Request},
+		{"timeouts.upstream", "UPSTREAM_TIMEOUT", cfg.Timeouts.Upstream},
+		{"timeouts.cep_api", "CEP_API_TIMEOUT", cfg.Timeouts.CepAPI},
+		{"timeouts.weather_api", "WEATHER_API_TIMEOUT", cfg.Timeouts.WeatherAPI},
+		{"timeouts.dial", "DIAL_TIMEOUT", cfg.Timeouts.Dial},
+		{"timeouts.tls_handshake", "TLS_HANDSHAKE_TIMEOUT", cfg.Timeouts.TLSHandshake},
+		{"timeouts.response_header", "RESPONSE_HEADER_TIMEOUT", cfg.Timeouts.ResponseHeader},
+		{"timeouts.adaptive.floor", "ADAPTIVE_TIMEOUT_FLOOR", cfg.Timeouts.Adaptive.Floor},
+		{"cache.cep_ttl", "CEP_CACHE_TTL", cfg.Cache.CepTTL},
+		{"cache.negative_ttl", "NEGATIVE_CACHE_TTL", cfg.Cache.NegativeTTL},
+		{"cache.cep_location_ttl", "CEP_LOCATION_CACHE_TTL", cfg.Cache.CepLocationTTL},
+		{"cache.geocode_ttl", "GEOCODE_CACHE_TTL", cfg.Cache.GeocodeTTL},
+		{"cache.weather_ttl", "WEATHER_CACHE_TTL", cfg.Cache.WeatherTTL},
+		{"cache.max_stale_age", "MAX_STALE_AGE", cfg.Cache.MaxStaleAge},
+		{"breaker.cooldown", "BREAKER_COOLDOWN", cfg.Breaker.Cooldown},
+		{"retries.backoff", "UPSTREAM_RETRY_BACKOFF", cfg.Retries.Backoff},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if value, err := time.ParseDuration(d.value); err != nil || value <= 0 {
+			return nil, fmt.Errorf("%s: %q is not a positive duration", d.path, d.value)
+		}
+		settings[d.key] = d.value
+	}
+
+	ints := []struct {
+		path, key string
+		value     *int
+	}{
+		{"cache.max_entries", "CACHE_MAX_ENTRIES", cfg.Cache.MaxEntries},
+		{"breaker.failure_threshold", "BREAKER_FAILURE_THRESHOLD", cfg.Breaker.FailureThreshold},
+		{"retries.count", "UPSTREAM_RETRIES", cfg.Retries.Count},
+	}
+	for _, i := range ints {
+		if i.value == nil {
+			continue
+		}
+		if *i.value <= 0 {
+			return nil, fmt.Errorf("%s: must be positive, got %d", i.path, *i.value)
+		}
+		settings[i.key] = strconv.Itoa(*i.value)
+	}
+
+	fractions := []struct {
+		path, key string
+		value     *float64
+	}{
+		{"timeouts.adaptive.percentile", "ADAPTIVE_TIMEOUT_PERCENTILE", cfg.Timeouts.Adaptive.Percentile},
+		{"cache.ttl_jitter", "CACHE_TTL_JITTER", cfg.Cache.TTLJitter},
+	}
+	for _, f := range fractions {
+		if f.value == nil {
+			continue
+		}
+		if *f.value < 0 || *f.value > 1 {
+			return nil, fmt.Errorf("%s: must be between 0 and 1, got %g", f.path, *f.value)
+		}
+		settings[f.key] = strconv.FormatFloat(*f.value, 'g', -1, 64)
+	}
+
+	bools := []struct {
+		key   string
+		value *bool
+	}{
+		{"ADAPTIVE_TIMEOUT", cfg.Timeouts.Adaptive.Enabled},
+		{"SERVE_STALE", cfg.Cache.ServeStale},
+	}
+	for _, b := range bools {
+		if b.value != nil {
+			settings[b.key] = strconv.FormatBool(*b.value)
+		}
+	}
+
+	if len(cfg.Retries.StatusCodes) > 0 {
+		codes := make([]string, len(cfg.Retries.StatusCodes))
+		for i, code := range cfg.Retries.StatusCodes {
+			if code < 100 || code > 599 {
+				return nil, fmt.Errorf("retries.status_codes: %d is not an HTTP status", code)
+			}
+			codes[i] = strconv.Itoa(code)
+		}
+		settings["RETRYABLE_STATUS_CODES"] = strings.Join(codes, ",")
+	}
+	return settings, nil
+}
+
+func knownCepProviderNames() map[string]bool {
+	names := make(map[string]bool, len(knownCepProviders))
+	for name := range knownCepProviders {
+		names[name] = true
+	}
+	return names
+}
@@ -0,0 +1,96 @@
+package main
+
+// AreaCode is a CEP's telephone area code (DDD) with the region it covers, when known.
+type AreaCode struct {
+	Code   string `json:"code"`
+	Region string `json:"region,omitempty"`
+}
+
+// dddRegions names the region each Brazilian area code covers.
+var dddRegions = map[string]string{
+	"11": "São Paulo e região metropolitana",
+	"12": "São José dos Campos e Vale do Paraíba (SP)",
+	"13": "Baixada Santista e Vale do Ribeira (SP)",
+	"14": "Bauru, Marília e Jaú (SP)",
+	"15": "Sorocaba e Itapetininga (SP)",
+	"16": "Ribeirão Preto, São Carlos e Franca (SP)",
+	"17": "São José do Rio Preto (SP)",
+	"18": "Presidente Prudente e Araçatuba (SP)",
+	"19": "Campinas e Piracicaba (SP)",
+	"21": "Rio de Janeiro e região metropolitana",
+	"22": "Campos dos Goytacazes e Região dos Lagos (RJ)",
+	"24": "Volta Redonda e Petrópolis (RJ)",
+	"27": "Vitória e região metropolitana (ES)",
+	"28": "Cachoeiro de Itapemirim (ES)",
+	"31": "Belo Horizonte e região metropolitana (MG)",
+	"32": "Juiz de Fora (MG)",
+	"33": "Governador Valadares (MG)",
+	"34": "Uberlândia e Triângulo Mineiro (MG)",
+	"35": "Poços de Caldas e Sul de Minas (MG)",
+	"37": "Divinópolis (MG)",
+	"38": "Montes Claros e Norte de Minas (MG)",
+	"41": "Curitiba e região metropolitana (PR)",
+	"42": "Ponta Grossa (PR)",
+	"43": "Londrina (PR)",
+	"44": "Maringá (PR)",
+	"45": "Cascavel e Foz do Iguaçu (PR)",
+	"46": "Francisco Beltrão e Pato Branco (PR)",
+	"47": "Joinville, Blumenau e Itajaí (SC)",
+	"48": "Florianópolis e Criciúma (SC)",
+	"49": "Chapecó e Lages (SC)",
+	"51": "Porto Alegre e região metropolitana (RS)",
+	"53": "Pelotas (RS)",
+	"54": "Caxias do Sul e Passo Fundo (RS)",
+	"55": "Santa Maria (RS)",
+	"61": "Distrito Federal e entorno",
+	"62": "Goiânia e região metropolitana (GO)",
+	"63": "Tocantins",
+	"64": "Rio Verde e Sul Goiano (GO)",
+	"65": "Cuiabá (MT)",
+	"66": "Rondonópolis e Sinop (MT)",
+	"67": "Mato Grosso do Sul",
+	"68": "Acre",
+	"69": "Rondônia",
+	"71": "Salvador e região metropolitana (BA)",
+	"73": "Ilhéus e Itabuna (BA)",
+	"74": "Juazeiro (BA)",
+	"75": "Feira de Santana (BA)",
+	"77": "Vitória da Conquista e Barreiras (BA)",
+	"79": "Sergipe",
+	"81": "Recife e região metropolitana (PE)",
+	"82": "Alagoas",
+	"83": "Paraíba",
+	"84": "Rio Grande do Norte",
+	"85": "Fortaleza e região metropolitana (CE)",
+	"86": "Teresina (PI)",
+	"87": "Petrolina e Sertão (PE)",
+	"88": "Juazeiro do Norte e Sobral (CE)",
+	"89": "Picos e Floriano (PI)",
+	"91": "Belém e região metropolitana (PA)",
+	"92": "Manaus (AM)",
+	"93": "Santarém (PA)",
+	"94": "Marabá (PA)",
+	"95": "Roraima",
+	"96": "Amapá",
+	"97": "Interior do Amazonas",
+	"98": "São Luís (MA)",
+	"99": "Imperatriz (MA)",
+}
+
+// newAreaCode returns the area code for ddd, or nil when it isn't two digits from 11 to 99.
+// A well-formed code missing from dddRegions is returned without a region.
+func newAreaCode(ddd string) *AreaCode {
+	if len(ddd) != 2 || !isDigits(ddd) || ddd[0] == '0' || ddd[1] == '0' {
+		return nil
+	}
+	return &AreaCode{Code: ddd, Region: dddRegions[ddd]}
+}
+
+func isDigits(s string) bool {
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
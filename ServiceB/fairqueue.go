@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// tenantBaggageKey is the W3C baggage member that names the tenant a request is made for.
+// Requests without it share the anonymous tenant "".
+const tenantBaggageKey = "tenant"
+
+func tenantFromContext(ctx context.Context) string {
+	return baggage.FromContext(ctx).Member(tenantBaggageKey).Value()
+}
+
+// fairLimiter bounds outbound calls in flight to capacity, and each tenant to perTenant of
+// them; a capacity of 0 means no limit. When calls have to wait, freed slots go round-robin
+// to the tenants that are waiting, so a tenant with a deep queue gets one slot per turn like
+// everyone else instead of all of them.
+type fairLimiter struct {
+	capacity int
+	// tenantMax is the configured per-tenant limit; perTenant is what applies under the
+	// current capacity.
+	tenantMax int
+	perTenant int
+
+	mu       sync.Mutex
+	inFlight int
+	active   map[string]int
+	queues   map[string][]chan struct{}
+	// order is the round-robin of tenants with waiters; the next slot goes to the first
+	// eligible one, which then moves to the back.
+	order []string
+}
+
+func newFairLimiter(capacity, perTenant int) *fairLimiter {
+	l := &fairLimiter{
+		tenantMax: perTenant,
+		active:    make(map[string]int),
+		queues:    make(map[string][]chan struct{}),
+	}
+	l.setCapacityLocked(capacity)
+	return l
+}
+
+// SetCapacity changes the limit for calls made from now on. Calls already in flight keep their
+// slots; a raised limit lets waiting calls through right away.
+func (l *fairLimiter) SetCapacity(capacity int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setCapacityLocked(capacity)
+	l.dispatchLocked()
+}
+
+func (l *fairLimiter) setCapacityLocked(capacity int) {
+	l.capacity = max(capacity, 0)
+	l.perTenant = l.tenantMax
+	if l.perTenant <= 0 || l.perTenant > l.capacity {
+		l.perTenant = l.capacity
+	}
+}
+
+// hasRoomLocked reports whether tenant may take a slot now.
+func (l *fairLimiter) hasRoomLocked(tenant string) bool {
+	return l.capacity == 0 || l.inFlight < l.capacity && l.active[tenant] < l.perTenant
+}
+
+// Acquire blocks until tenant may make a call or ctx is done. Every nil return must be paired
+// with a Release.
+func (l *fairLimiter) Acquire(ctx context.Context, tenant string) error {
+	l.mu.Lock()
+	if len(l.queues[tenant]) == 0 && l.hasRoomLocked(tenant) {
+		l.grantLocked(tenant)
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{}, 1)
+	if len(l.queues[tenant]) == 0 {
+		l.order = append(l.order, tenant)
+	}
+	l.queues[tenant] = append(l.queues[tenant], ready)
+	upstreamQueueWaiting.Inc()
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i := slices.Index(l.queues[tenant], ready); i >= 0 {
+		l.dequeueLocked(tenant, i)
+		return ctx.Err()
+	}
+	// Granted while giving up: hand the slot on.
+	l.releaseLocked(tenant)
+	return ctx.Err()
+}
+
+func (l *fairLimiter) Release(tenant string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked(tenant)
+}
+
+func (l *fairLimiter) grantLocked(tenant string) {
+	l.inFlight++
+	l.active[tenant]++
+}
+
+func (l *fairLimiter) releaseLocked(tenant string) {
+	l.inFlight--
+	if l.active[tenant]--; l.active[tenant] == 0 {
+		delete(l.active, tenant)
+	}
+	l.dispatchLocked()
+}
+
+func (l *fairLimiter) dequeueLocked(tenant string, i int) {
+	l.queues[tenant] = slices.Delete(l.queues[tenant], i, i+1)
+	upstreamQueueWaiting.Dec()
+	if len(l.queues[tenant]) == 0 {
+		delete(l.queues, tenant)
+		l.order = slices.DeleteFunc(l.order, func(t string) bool { return t == tenant })
+	}
+}
+
+// dispatchLocked hands free slots to waiting tenants in round-robin order, skipping tenants
+// already at their own limit.
+func (l *fairLimiter) dispatchLocked() {
+	for len(l.order) > 0 {
+		i := slices.IndexFunc(l.order, l.hasRoomLocked)
+		if i < 0 {
+			return
+		}
+		tenant := l.order[i]
+		ready := l.queues[tenant][0]
+		l.dequeueLocked(tenant, 0)
+		if _, waiting := l.queues[tenant]; waiting {
+			l.order = append(slices.Delete(l.order, i, i+1), tenant)
+		}
+		l.grantLocked(tenant)
+		ready <- struct{}{}
+	}
+}
+
+// limitedTransport makes every request through next hold a fairLimiter slot, for its tenant,
+// until the response body is closed.
+type limitedTransport struct {
+	next    http.RoundTripper
+	limiter *fairLimiter
+}
+
+func (t limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tenant := tenantFromContext(req.Context())
+	if err := t.limiter.Acquire(req.Context(), tenant); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.limiter.Release(tenant)
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { t.limiter.Release(tenant) }}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// waitQueued blocks until tenant has n calls waiting on l.
+func waitQueued(t *testing.T, l *fairLimiter, tenant string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		l.mu.Lock()
+		queued := len(l.queues[tenant])
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q has %d calls waiting, want %d", tenant, queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairLimiterTakesTurnsBetweenTenants(t *testing.T) {
+	l := newFairLimiter(1, 0)
+	if err := l.Acquire(context.Background(), "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The noisy tenant queues four calls before the quiet one queues its single call.
+	granted := make(chan string)
+	queue := func(tenant string, n int) {
+		for i := range n {
+			go func() {
+				if err := l.Acquire(context.Background(), tenant); err != nil {
+					t.Error(err)
+				}
+				granted <- tenant
+			}()
+			waitQueued(t, l, tenant, i+1)
+		}
+	}
+	queue("noisy", 4)
+	queue("quiet", 1)
+
+	// Each slot is handed back as soon as its holder reports in, so the grants come one at
+	// a time in the order the limiter chose.
+	l.Release("first")
+	var order []string
+	for range 5 {
+		tenant := <-granted
+		order = append(order, tenant)
+		l.Release(tenant)
+	}
+	if want := []string{"noisy", "quiet", "noisy", "noisy", "noisy"}; !slices.Equal(order, want) {
+		t.Errorf("slots went to %v, want %v", order, want)
+	}
+}
+
+func TestFairLimiterPerTenantMax(t *testing.T) {
+	l := newFairLimiter(3, 2)
+	for range 2 {
+		if err := l.Acquire(context.Background(), "noisy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A slot is free, but not for the tenant already at its own limit.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, "noisy"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("third noisy call: err = %v, want it to wait past its deadline", err)
+	}
+	if err := l.Acquire(context.Background(), "quiet"); err != nil {
+		t.Errorf("quiet call: err = %v, want the free slot", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight != 3 || len(l.queues) != 0 || len(l.order) != 0 {
+		t.Errorf("in flight %d, queues %v, order %v, want 3 and nothing waiting", l.inFlight, l.queues, l.order)
+	}
+}
+
+func TestLimitedTransportLimitsByBaggageTenant(t *testing.T) {
+	release := make(chan struct{})
+	var (
+		mu      sync.Mutex
+		tenants []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tenants = append(tenants, r.URL.Query().Get("tenant"))
+		mu.Unlock()
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+
+	l := newFairLimiter(2, 1)
+	client := &http.Client{Transport: limitedTransport{next: http.DefaultTransport, limiter: l}}
+	call := func(ctx context.Context, tenant string) error {
+		member, _ := baggage.NewMember(tenantBaggageKey, tenant)
+		bag, _ := baggage.New(member)
+		req, _ := http.NewRequestWithContext(baggage.ContextWithBaggage(ctx, bag), http.MethodGet, upstream.URL+"?tenant="+tenant, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	go call(context.Background(), "noisy")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		inFlight := l.inFlight
+		l.mu.Unlock()
+		if inFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the first noisy call never got a slot")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := call(ctx, "noisy"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second noisy call: err = %v, want it held back", err)
+	}
+	go call(context.Background(), "quiet")
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		seen := slices.Sorted(slices.Values(tenants))
+		mu.Unlock()
+		if slices.Equal(seen, []string{"noisy", "quiet"}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream saw %v, want one noisy and one quiet call", seen)
+		}
+	}
+}
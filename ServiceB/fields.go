@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// temperatureFields is the set of JSON field names a client may ask for in ?fields=.
+var temperatureFields = jsonFieldNames(reflect.TypeFor[Temperature]())
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// parseFields reads ?fields=a,b (repeatable). It returns nil when the parameter is absent and
+// the names that aren't Temperature fields, if any.
+func parseFields(r *http.Request) (fields []string, unknown []string) {
+	for _, value := range r.URL.Query()["fields"] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if !temperatureFields[item] {
+				unknown = append(unknown, item)
+				continue
+			}
+			fields = append(fields, item)
+		}
+	}
+	return fields, unknown
+}
+
+// selectFields marshals v and keeps only the given top-level fields. Fields v leaves out (the
+// omitempty ones) stay out even when requested.
+func selectFields(v any, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	subset := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			subset[field] = value
+		}
+	}
+	return subset, nil
+}
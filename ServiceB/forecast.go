@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// ForecastApiResponse is the daily part of open-meteo's forecast. Near the end of its range
+// the arrays can be shorter than the days asked for, and single values can be null.
+type ForecastApiResponse struct {
+	Daily struct {
+		Time             []string   `json:"time"`
+		Temperature2MMax []*float64 `json:"temperature_2m_max"`
+		Temperature2MMin []*float64 `json:"temperature_2m_min"`
+	} `json:"daily"`
+}
+
+// ForecastDay is one local calendar day of the forecast.
+type ForecastDay struct {
+	Date string  `json:"date"`
+	MinC float64 `json:"min_C"`
+	MaxC float64 `json:"max_C"`
+}
+
+// Forecast is the reply of GET /{cep}/forecast. Days is how many days came back, which can be
+// fewer than Requested when open-meteo has no data that far ahead.
+type Forecast struct {
+	City      string        `json:"city"`
+	Requested int           `json:"requested"`
+	Days      int           `json:"days"`
+	Forecast  []ForecastDay `json:"forecast"`
+}
+
+// forecastDays pairs up the daily arrays, up to requested days. It stops at the shortest
+// array and skips days missing either temperature, so a partial response yields fewer days
+// rather than zeros.
+func forecastDays(resp *ForecastApiResponse, requested int) []ForecastDay {
+	daily := resp.Daily
+	n := min(requested, len(daily.Time), len(daily.Temperature2MMax), len(daily.Temperature2MMin))
+	days := make([]ForecastDay, 0, n)
+	for i := range n {
+		if daily.Temperature2MMax[i] == nil || daily.Temperature2MMin[i] == nil {
+			continue
+		}
+		days = append(days, ForecastDay{
+			Date: daily.Time[i],
+			MinC: *daily.Temperature2MMin[i],
+			MaxC: *daily.Temperature2MMax[i],
+		})
+	}
+	return days
+}
+
+// HandlerForecast returns the daily minimum and maximum temperature at a CEP for the next
+// ?days= days (default 7).
+func HandlerForecast(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "HandlerForecast")
+	defer span.End()
+
+	cep, err := parseCep(chi.URLParam(r, "cep"))
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidZipcode)
+		return
+	}
+	requested := 7
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		requested, err = strconv.Atoi(raw)
+		if err != nil || requested < 1 || requested > forecastMaxDays {
+			writeError(w, r, http.StatusUnprocessableEntity, codeInvalidDays, forecastMaxDays)
+			return
+		}
+	}
+
+	cepResponse, _, err := LookupCepLocation(ctx, cep)
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	latitude, longitude, _, err := weatherCoordinates(ctx, cepResponse)
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	forecast, err := WeatherForecast(ctx, latitude, longitude, requested)
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	days := forecastDays(forecast, requested)
+	span.SetAttributes(attribute.Int("forecast.requested", requested), attribute.Int("forecast.days", len(days)))
+	if len(days) == 0 {
+		writeError(w, r, http.StatusUnprocessableEntity, codeWeatherUnavailable)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Forecast{
+		City:      cepResponse.City,
+		Requested: requested,
+		Days:      len(days),
+		Forecast:  days,
+	})
+}
+
+// WeatherForecast fetches the daily extremes for the next days days, in the location's own
+// time zone so each day is a local calendar day.
+func WeatherForecast(ctx context.Context, latitude, longitude string, days int) (*ForecastApiResponse, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "WeatherForecast")
+	defer span.End()
+
+	query := url.Values{
+		"latitude":      {latitude},
+		"longitude":     {longitude},
+		"daily":         {"temperature_2m_max,temperature_2m_min"},
+		"forecast_days": {strconv.Itoa(days)},
+		"timezone":      {"auto"},
+	}
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "openmeteo"), "GET", openMeteoBaseURL+"/v1/forecast?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("openmeteo", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("openmeteo", resp, body, fmt.Errorf("forecast api returned %d", resp.StatusCode))
+	}
+
+	var forecast ForecastApiResponse
+	if err := decodeUpstreamJSON("openmeteo", resp, body, &forecast); err != nil {
+		return nil, err
+	}
+	return &forecast, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestForecastDays(t *testing.T) {
+	var resp ForecastApiResponse
+	// Three dates, but the minimums stop after two and the second maximum is null.
+	err := json.Unmarshal([]byte(`{"daily":{
+		"time":["2024-05-01","2024-05-02","2024-05-03"],
+		"temperature_2m_max":[25.1,null,27.3],
+		"temperature_2m_min":[15.2,16.4]
+	}}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requested int
+		want      []ForecastDay
+	}{
+		{requested: 7, want: []ForecastDay{{Date: "2024-05-01", MinC: 15.2, MaxC: 25.1}}},
+		{requested: 1, want: []ForecastDay{{Date: "2024-05-01", MinC: 15.2, MaxC: 25.1}}},
+	}
+	for _, tt := range tests {
+		if got := forecastDays(&resp, tt.requested); !slices.Equal(got, tt.want) {
+			t.Errorf("forecastDays(%d) = %+v, want %+v", tt.requested, got, tt.want)
+		}
+	}
+
+	if got := forecastDays(&ForecastApiResponse{}, 7); len(got) != 0 {
+		t.Errorf("forecastDays(empty) = %+v, want no days", got)
+	}
+}
+
+func TestHandlerForecastShorterThanRequested(t *testing.T) {
+	newFixtureServer(t, "success")
+	var forecastDaysAsked string
+	forecast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forecastDaysAsked = r.URL.Query().Get("forecast_days")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"daily":{
+			"time":["2024-05-01","2024-05-02","2024-05-03"],
+			"temperature_2m_max":[25.1,26.2,27.3],
+			"temperature_2m_min":[15.2,16.4,17.5]
+		}}`))
+	}))
+	t.Cleanup(forecast.Close)
+	setForTest(t, &openMeteoBaseURL, forecast.URL)
+
+	router := chi.NewRouter()
+	router.Get("/{cep}/forecast", HandlerForecast)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/01001000/forecast?days=10", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got Forecast
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	if forecastDaysAsked != "10" {
+		t.Errorf("open-meteo asked for %s days, want 10", forecastDaysAsked)
+	}
+	if got.Requested != 10 || got.Days != 3 || len(got.Forecast) != 3 || got.Forecast[2] != (ForecastDay{Date: "2024-05-03", MinC: 17.5, MaxC: 27.3}) {
+		t.Errorf("got %+v, want the 3 days available out of 10", got)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+var errCityNotFound = errors.New("city not found")
+
+// errNoCoordinates means a CEP exists but neither the provider's coordinates (missing, 0,0 or
+// outside Brazil) nor its geocoded city give a place to ask for weather.
+var errNoCoordinates = errors.New("cep has no usable coordinates")
+
+type GeocodingResult struct {
+	Name        string  `json:"name"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	CountryCode string  `json:"country_code"`
+	Admin1      string  `json:"admin1"`
+}
+
+type GeocodingResponse struct {
+	Results []GeocodingResult `json:"results"`
+}
+
+// Geocoder resolves a Brazilian city to coordinates. state is the full state name
+// (e.g. "São Paulo") and tells homonymous cities apart; an empty state takes the best match.
+type Geocoder interface {
+	Name() string
+	Geocode(ctx context.Context, city, state string) (*GeocodingResult, error)
+}
+
+var geocoder Geocoder = newLimitedGeocoder(newGeocoder(envString("GEOCODER", "openmeteo")), geocoderRateLimit, geocoderMaxConcurrency)
+
+func newGeocoder(name string) Geocoder {
+	switch name {
+	case "nominatim":
+		return &nominatimGeocoder{userAgent: nominatimUserAgent}
+	case "openmeteo":
+	default:
+		log.Printf("unknown geocoder %q, using openmeteo", name)
+	}
+	return openMeteoGeocoder{}
+}
+
+var geocodeCache = newCache[GeocodingResult]("geocode")
+
+// geocodeMisses holds the cities the geocoder doesn't know, apart from geocodeCache so a run
+// of unresolvable names can't push real coordinates out of it. It is always in memory: a miss
+// is cheap to relearn.
+var geocodeMisses = newNegativeLRU("geocode_negative", geocodeNegativeCacheMaxEntries)
+
+// GeocodeCity resolves city/state with the configured geocoder. Coordinates of a city don't
+// change and are cached for long; cities the geocoder doesn't know are remembered briefly.
+func GeocodeCity(ctx context.Context, city, state string) (*GeocodingResult, error) {
+	key := geocodeCacheKey(city, state)
+	if !cacheBypassed(ctx, "geocode_negative", key) && geocodeMisses.Contains(key) {
+		traceCacheLookup(ctx, "geocode_negative", key, true, true)
+		return nil, errCityNotFound
+	}
+	entry, ok := cacheGet(ctx, geocodeCache, "geocode", key)
+	ok = ok && !entry.Negative
+	traceCacheLookup(ctx, "geocode", key, ok, false)
+	if ok {
+		return &entry.Value, nil
+	}
+
+	result, err := geocoder.Geocode(ctx, city, state)
+	switch {
+	case err == nil:
+		geocodeCache.Set(key, *result, geocodeCacheTTL)
+	case errors.Is(err, errCityNotFound):
+		geocodeMisses.Add(key, geocodeNegativeCacheTTL)
+	}
+	return result, err
+}
+
+// geocodeCacheKey folds case and whitespace so "São  Paulo" and "são paulo" share an entry.
+func geocodeCacheKey(city, state string) string {
+	normalize := func(s string) string { return strings.Join(strings.Fields(strings.ToLower(s)), " ") }
+	return normalize(city) + "|" + normalize(state)
+}
+
+// stateNames maps UFs to the state names geocoders return, for providers that only give the UF.
+var stateNames = map[string]string{
+	"AC": "Acre", "AL": "Alagoas", "AP": "Amapá", "AM": "Amazonas", "BA": "Bahia",
+	"CE": "Ceará", "DF": "Distrito Federal", "ES": "Espírito Santo", "GO": "Goiás",
+	"MA": "Maranhão", "MT": "Mato Grosso", "MS": "Mato Grosso do Sul", "MG": "Minas Gerais",
+	"PA": "Pará", "PB": "Paraíba", "PR": "Paraná", "PE": "Pernambuco", "PI": "Piauí",
+	"RJ": "Rio de Janeiro", "RN": "Rio Grande do Norte", "RS": "Rio Grande do Sul",
+	"RO": "Rondônia", "RR": "Roraima", "SC": "Santa Catarina", "SP": "São Paulo",
+	"SE": "Sergipe", "TO": "Tocantins",
+}
+
+// plausibleCoordinates reports whether lat/lng parse and fall inside Brazil's bounding box
+// (islands included). 0,0 and coordinates swapped or with a lost sign all fail.
+func plausibleCoordinates(latitude, longitude string) bool {
+	lat, err := strconv.ParseFloat(latitude, 64)
+	if err != nil {
+		return false
+	}
+	lng, err := strconv.ParseFloat(longitude, 64)
+	if err != nil {
+		return false
+	}
+	return lat >= -34 && lat <= 6 && lng >= -74 && lng <= -28
+}
+
+// weatherCoordinates returns where to ask for a CEP's weather: the provider's coordinates when
+// they are plausible, otherwise the geocoded city center, reported as approximate.
+func weatherCoordinates(ctx context.Context, cep *CepAwesomeapiResponse) (latitude, longitude string, approximate bool, err error) {
+	if plausibleCoordinates(cep.Latitude, cep.Longitude) {
+		return cep.Latitude, cep.Longitude, false, nil
+	}
+
+	logFromCtx(ctx).Warn("implausible CEP coordinates, geocoding the city instead",
+		slog.String("cep", cep.Cep),
+		slog.String("latitude", cep.Latitude),
+		slog.String("longitude", cep.Longitude),
+	)
+	state := cep.State
+	if name, ok := stateNames[strings.ToUpper(state)]; ok {
+		state = name
+	}
+	location, err := GeocodeCity(ctx, cep.City, state)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%w: geocoding %s/%s: %w", errNoCoordinates, cep.City, cep.State, err)
+	}
+	return strconv.FormatFloat(location.Latitude, 'f', -1, 64), strconv.FormatFloat(location.Longitude, 'f', -1, 64), true, nil
+}
+
+type openMeteoGeocoder struct{}
+
+func (openMeteoGeocoder) Name() string { return "openmeteo" }
+
+func (openMeteoGeocoder) Geocode(ctx context.Context, city, state string) (*GeocodingResult, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "OpenMeteoGeocode")
+	defer span.End()
+
+	query := url.Values{}
+	query.Set("name", city)
+	query.Set("count", "10")
+	query.Set("language", "pt")
+	query.Set("countryCode", "BR")
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "openmeteo-geocoding"), "GET", openMeteoGeocodeBaseURL+"/v1/search?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("openmeteo-geocoding", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("openmeteo-geocoding", resp, body, fmt.Errorf("geocoding api returned %d", resp.StatusCode))
+	}
+
+	var geocodingResponse GeocodingResponse
+	if err := decodeUpstreamJSON("openmeteo-geocoding", resp, body, &geocodingResponse); err != nil {
+		return nil, err
+	}
+
+	for _, result := range geocodingResponse.Results {
+		if state == "" || strings.EqualFold(result.Admin1, state) {
+			return &result, nil
+		}
+	}
+	return nil, errCityNotFound
+}
+
+type NominatimResult struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+}
+
+// nominatimGeocoder queries OpenStreetMap's Nominatim, which catches small towns open-meteo
+// misses. Its usage policy requires an identifying User-Agent and at most one request per
+// second, which limitedGeocoder enforces through geocoderPolicyRates.
+type nominatimGeocoder struct {
+	userAgent string
+}
+
+func (*nominatimGeocoder) Name() string { return "nominatim" }
+
+func (g *nominatimGeocoder) Geocode(ctx context.Context, city, state string) (*GeocodingResult, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "NominatimGeocode")
+	defer span.End()
+
+	query := url.Values{}
+	query.Set("city", city)
+	if state != "" {
+		query.Set("state", state)
+	}
+	query.Set("country", "Brazil")
+	query.Set("format", "jsonv2")
+	query.Set("limit", "1")
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "nominatim"), "GET", nominatimBaseURL+"/search?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("nominatim", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("nominatim", resp, body, fmt.Errorf("nominatim api returned %d", resp.StatusCode))
+	}
+
+	var results []NominatimResult
+	if err := decodeUpstreamJSON("nominatim", resp, body, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errCityNotFound
+	}
+
+	latitude, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid coordinates: %w", err)
+	}
+	longitude, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid coordinates: %w", err)
+	}
+	return &GeocodingResult{
+		Name:        results[0].Name,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		CountryCode: "BR",
+		Admin1:      state,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestPlausibleCoordinates(t *testing.T) {
+	tests := []struct {
+		latitude, longitude string
+		want                bool
+	}{
+		{"-23.5502784", "-46.6342179", true},
+		{"3.8", "-61.3", true},
+		{"-3.85", "-32.42", true}, // Fernando de Noronha
+		{"0", "0", false},
+		{"-46.6342179", "-23.5502784", false}, // swapped
+		{"23.5502784", "46.6342179", false},   // signs lost
+		{"", "", false},
+		{"-23.5", "abc", false},
+	}
+	for _, tt := range tests {
+		if got := plausibleCoordinates(tt.latitude, tt.longitude); got != tt.want {
+			t.Errorf("plausibleCoordinates(%q, %q) = %v, want %v", tt.latitude, tt.longitude, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerCepZeroCoordinatesGeocodeTheCity(t *testing.T) {
+	newFixtureServer(t, "zero_coords")
+	var weatherQuery map[string][]string
+	weather := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		weatherQuery = r.URL.Query()
+		http.ServeFile(w, r, "testdata/fixtures/success/openmeteo.json")
+	}))
+	t.Cleanup(weather.Close)
+	setForTest(t, &openMeteoBaseURL, weather.URL)
+	geo := &fixedGeocoder{result: GeocodingResult{Name: "São Paulo", Latitude: -23.5475, Longitude: -46.63611, CountryCode: "BR", Admin1: "São Paulo"}}
+	setForTest[Geocoder](t, &geocoder, geo)
+
+	rec := serveCep(t, "/01001000")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var got Temperature
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	if !got.Approximate || got.City != "São Paulo" || got.TempC != 21.4 {
+		t.Errorf("got %+v, want the approximate temperature of São Paulo", got)
+	}
+	// The UF is spelled out for the geocoder, and the weather is asked for the city center.
+	if calls := geo.Calls(); !slices.Equal(calls, []string{"São Paulo/São Paulo"}) {
+		t.Errorf("geocoded %v, want [São Paulo/São Paulo]", calls)
+	}
+	if weatherQuery["latitude"][0] != "-23.5475" || weatherQuery["longitude"][0] != "-46.63611" {
+		t.Errorf("weather asked for %v, want the geocoded coordinates", weatherQuery)
+	}
+}
+
+func TestHandlerCepZeroCoordinatesWithoutGeocodeIsUnavailable(t *testing.T) {
+	upstream := newFixtureServer(t, "zero_coords")
+	setForTest(t, &geocoder, Geocoder(failingGeocoder{errCityNotFound}))
+
+	rec := serveCep(t, "/01001000")
+	var body ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusUnprocessableEntity || body.Code != codeWeatherUnavailable {
+		t.Errorf("status = %d, body %s, want 422 %q", rec.Code, rec.Body, codeWeatherUnavailable)
+	}
+	// The Gulf of Guinea's weather is never asked for.
+	if n := upstream.Calls("/v1/forecast"); n != 0 {
+		t.Errorf("open-meteo called %d times, want 0", n)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errGeocoderBusy means a geocode request couldn't get a slot under GEOCODER_RATE_LIMIT or
+// GEOCODER_MAX_CONCURRENCY before its deadline.
+var errGeocoderBusy = errors.New("geocoder rate limit reached, no request slot before the deadline")
+
+// geocoderPolicyRates are the most requests per second a geocoder's usage policy allows.
+// Nominatim's is one per second; geocoders missing here have no published limit.
+var geocoderPolicyRates = map[string]float64{
+	"nominatim": 1,
+}
+
+// limitedGeocoder spaces requests to the wrapped geocoder at least interval apart and keeps
+// at most cap(sem) of them in flight.
+type limitedGeocoder struct {
+	Geocoder
+	interval time.Duration
+	sem      chan struct{}
+
+	mu sync.Mutex
+	// next is the earliest start time the next request may reserve.
+	next time.Time
+}
+
+// newLimitedGeocoder wraps g with a limit of rate requests per second, 0 meaning g's policy
+// rate or none, and concurrency requests in flight. A rate above the policy is lowered to it.
+func newLimitedGeocoder(g Geocoder, rate float64, concurrency int) *limitedGeocoder {
+	if policy, ok := geocoderPolicyRates[g.Name()]; ok && (rate == 0 || rate > policy) {
+		if rate > policy {
+			log.Printf("GEOCODER_RATE_LIMIT %g exceeds %s's usage policy, using %g", rate, g.Name(), policy)
+		}
+		rate = policy
+	}
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	return &limitedGeocoder{Geocoder: g, interval: interval, sem: make(chan struct{}, concurrency)}
+}
+
+func (g *limitedGeocoder) Geocode(ctx context.Context, city, state string) (*GeocodingResult, error) {
+	if err := g.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-g.sem }()
+	return g.Geocoder.Geocode(ctx, city, state)
+}
+
+// acquire takes a concurrency slot and then waits for the request's turn under the rate
+// limit. A turn that would come after ctx's deadline is refused right away rather than
+// waited for. Turns are reserved up front, so a caller that gives up still leaves its gap.
+func (g *limitedGeocoder) acquire(ctx context.Context) error {
+	select {
+	case g.sem <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errGeocoderBusy, ctx.Err())
+	}
+	if g.interval <= 0 {
+		return nil
+	}
+
+	g.mu.Lock()
+	slot := g.next
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	if deadline, ok := ctx.Deadline(); ok && slot.After(deadline) {
+		g.mu.Unlock()
+		<-g.sem
+		return errGeocoderBusy
+	}
+	g.next = slot.Add(g.interval)
+	g.mu.Unlock()
+
+	wait := time.Until(slot)
+	if wait <= 0 {
+		return nil
+	}
+	trace.SpanFromContext(ctx).AddEvent("geocoder.rate_limited", trace.WithAttributes(
+		stringAttr("geocoder", g.Name()),
+		attribute.Int64("wait_ms", wait.Milliseconds()),
+	))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		<-g.sem
+		return fmt.Errorf("%w: %w", errGeocoderBusy, ctx.Err())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fixtureResponse is one recorded upstream response, its body read from testdata/fixtures.
+type fixtureResponse struct {
+	status      int
+	contentType string
+	file        string
+}
+
+// fixtureSets are the recorded awesomeapi and open-meteo responses, by set and then by the
+// path prefix the upstream serves them under.
+var fixtureSets = map[string]map[string]fixtureResponse{
+	"success": {
+		"/json/":       {http.StatusOK, "application/json; charset=utf-8", "success/awesomeapi.json"},
+		"/v1/forecast": {http.StatusOK, "application/json; charset=utf-8", "success/openmeteo.json"},
+	},
+	"not_found": {
+		"/json/":       {http.StatusNotFound, "application/json; charset=utf-8", "not_found/awesomeapi.json"},
+		"/v1/forecast": {http.StatusBadRequest, "application/json; charset=utf-8", "not_found/openmeteo.json"},
+	},
+	"rate_limited": {
+		"/json/":       {http.StatusTooManyRequests, "application/json; charset=utf-8", "rate_limited/awesomeapi.json"},
+		"/v1/forecast": {http.StatusTooManyRequests, "application/json; charset=utf-8", "rate_limited/openmeteo.json"},
+	},
+	"multiple": {
+		"/json/":       {http.StatusOK, "application/json; charset=utf-8", "multiple/awesomeapi.json"},
+		"/v1/forecast": {http.StatusOK, "application/json; charset=utf-8", "success/openmeteo.json"},
+	},
+	"zero_coords": {
+		"/json/":       {http.StatusOK, "application/json; charset=utf-8", "zero_coords/awesomeapi.json"},
+		"/v1/forecast": {http.StatusOK, "application/json; charset=utf-8", "success/openmeteo.json"},
+	},
+	"malformed": {
+		"/json/":       {http.StatusOK, "text/html; charset=UTF-8", "malformed/awesomeapi.html"},
+		"/v1/forecast": {http.StatusOK, "application/json; charset=utf-8", "malformed/openmeteo.json"},
+	},
+}
+
+// fixtureServer stands in for awesomeapi and open-meteo, answering every call with the
+// recorded response of one fixture set.
+type fixtureServer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls map[string]int
+	paths []string
+}
+
+// newFixtureServer serves the fixture set named set for the rest of the test. The CEP and
+// weather chains are isolated to awesomeapi and open-meteo, both pointed at the server.
+func newFixtureServer(t *testing.T, set string) *fixtureServer {
+	t.Helper()
+	responses, ok := fixtureSets[set]
+	if !ok {
+		t.Fatalf("unknown fixture set %q", set)
+	}
+
+	s := &fixtureServer{calls: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for prefix, response := range responses {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				continue
+			}
+			s.mu.Lock()
+			s.calls[prefix]++
+			s.paths = append(s.paths, r.URL.Path)
+			s.mu.Unlock()
+
+			body, err := os.ReadFile(filepath.Join("testdata", "fixtures", response.file))
+			if err != nil {
+				t.Errorf("reading fixture: %s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", response.contentType)
+			w.WriteHeader(response.status)
+			w.Write(body)
+			return
+		}
+		t.Errorf("unexpected upstream call %s", r.URL)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, s.URL)
+	setForTest(t, &openMeteoBaseURL, s.URL)
+	return s
+}
+
+// Calls is how many requests the server answered under the path prefix.
+func (s *fixtureServer) Calls(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[prefix]
+}
+
+// Paths is every path the server answered, in order.
+func (s *fixtureServer) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.paths...)
+}
+
+// isolateUpstreams gives the test empty caches and fresh breakers, with only awesomeapi in
+// the CEP chain and only open-meteo in the weather chain, restoring the package's own when
+// the test ends.
+func isolateUpstreams(t *testing.T) {
+	t.Helper()
+	setForTest(t, &cepCache, newCache[CepAwesomeapiResponse]("cep"))
+	setForTest(t, &cepLocationCache, newCache[CepLocation]("cep_location"))
+	setForTest(t, &geocodeCache, newCache[GeocodingResult]("geocode"))
+	setForTest(t, &geocodeMisses, newNegativeLRU("geocode_negative", geocodeNegativeCacheMaxEntries))
+	setForTest(t, &weatherCache, newCache[cachedWeather]("weather"))
+	setForTest(t, &cepProviders, newCepProviders([]string{"awesomeapi"}))
+	setForTest(t, &weatherProviders, newWeatherProviders([]string{"openmeteo"}))
+}
+
+// setForTest sets *p to value until the test ends.
+func setForTest[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	saved := *p
+	*p = value
+	t.Cleanup(func() { *p = saved })
+}
+
+// failingGeocoder fails every lookup with err.
+type failingGeocoder struct{ err error }
+
+func (failingGeocoder) Name() string { return "failing" }
+
+func (g failingGeocoder) Geocode(context.Context, string, string) (*GeocodingResult, error) {
+	return nil, g.err
+}
+
+// fixedGeocoder places every city at result, recording what it was asked.
+type fixedGeocoder struct {
+	result GeocodingResult
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (*fixedGeocoder) Name() string { return "fixed" }
+
+func (g *fixedGeocoder) Geocode(_ context.Context, city, state string) (*GeocodingResult, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, city+"/"+state)
+	result := g.result
+	return &result, nil
+}
+
+// Calls returns the city/state pairs geocoded so far.
+func (g *fixedGeocoder) Calls() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.calls...)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Error codes are part of the API contract: stable and locale-independent. Only the
+// human-readable message that goes with them is translated.
+const (
+	codeInvalidZipcode     = "invalid_zipcode"
+	codeZipcodeNotFound    = "zipcode_not_found"
+	codeInvalidIbgeCode    = "invalid_ibge_code"
+	codeIbgeCodeNotFound   = "ibge_code_not_found"
+	codeUpstreamError      = "upstream_error"
+	codeInvalidPayload     = "invalid_payload"
+	codeInvalidBatchSize   = "invalid_batch_size"
+	codeInvalidFields      = "invalid_fields"
+	codeInvalidInclude     = "invalid_include"
+	codeOverloaded         = "overloaded"
+	codeShuttingDown       = "shutting_down"
+	codeUnauthorized       = "unauthorized"
+	codeWeatherUnavailable = "weather_unavailable"
+	codeInternalError      = "internal_error"
+	codeWarmupNotFound     = "warmup_not_found"
+	codeInvalidDateRange   = "invalid_date_range"
+	codeInvalidDays        = "invalid_days"
+	codeInvalidModel       = "invalid_model"
+	codeInvalidDelay       = "invalid_delay"
+	codeUnknownQuery       = "unknown_query_params"
+	codeUpstreamTimeout    = "upstream_timeout"
+)
+
+// fallbackLocale is also the language of the legacy "error" field.
+const fallbackLocale = "en"
+
+var messages = map[string]map[string]string{
+	"en": {
+		codeInvalidZipcode:     "invalid zipcode",
+		codeZipcodeNotFound:    "can not find zipcode",
+		codeInvalidIbgeCode:    "invalid ibge code",
+		codeIbgeCodeNotFound:   "can not find ibge code",
+		codeUpstreamError:      "upstream error",
+		codeInvalidPayload:     "invalid payload",
+		codeInvalidBatchSize:   "ceps must contain between 1 and %d items",
+		codeInvalidFields:      "unknown fields: %s",
+		codeInvalidInclude:     "unknown include values: %s",
+		codeOverloaded:         "service overloaded, try again later",
+		codeShuttingDown:       "service shutting down, try another instance",
+		codeUnauthorized:       "unauthorized",
+		codeWeatherUnavailable: "weather not available for this location",
+		codeInternalError:      "internal error",
+		codeWarmupNotFound:     "warmup job not found",
+		codeInvalidDateRange:   "from and to must be past dates (YYYY-MM-DD), from not after to, spanning at most %d days",
+		codeInvalidDays:        "days must be an integer from 1 to %d",
+		codeInvalidModel:       "unknown weather model: %s",
+		codeInvalidDelay:       "delay must be a duration such as 500ms, up to %s",
+		codeUnknownQuery:       "unknown query parameters: %s",
+		codeUpstreamTimeout:    "upstream did not answer in time",
+	},
+	"pt-BR": {
+		codeInvalidZipcode:     "CEP inválido",
+		codeZipcodeNotFound:    "CEP não encontrado",
+		codeInvalidIbgeCode:    "código IBGE inválido",
+		codeIbgeCodeNotFound:   "código IBGE não encontrado",
+		codeUpstreamError:      "falha ao consultar serviço externo",
+		codeInvalidPayload:     "corpo da requisição inválido",
+		codeInvalidBatchSize:   "ceps deve conter entre 1 e %d itens",
+		codeInvalidFields:      "campos desconhecidos: %s",
+		codeInvalidInclude:     "valores desconhecidos em include: %s",
+		codeOverloaded:         "serviço sobrecarregado, tente novamente em instantes",
+		codeShuttingDown:       "serviço em desligamento, tente outra instância",
+		codeUnauthorized:       "não autorizado",
+		codeWeatherUnavailable: "clima indisponível para esta localização",
+		codeInternalError:      "erro interno",
+		codeWarmupNotFound:     "tarefa de aquecimento não encontrada",
+		codeInvalidDateRange:   "from e to devem ser datas passadas (AAAA-MM-DD), com from até to e no máximo %d dias",
+		codeInvalidDays:        "days deve ser um inteiro de 1 a %d",
+		codeInvalidModel:       "modelo de clima desconhecido: %s",
+		codeInvalidDelay:       "delay deve ser uma duração como 500ms, até %s",
+		codeUnknownQuery:       "parâmetros de consulta desconhecidos: %s",
+		codeUpstreamTimeout:    "serviço externo não respondeu a tempo",
+	},
+}
+
+// negotiateLocale returns the first supported language in an Accept-Language header, in the
+// order the client listed them, or DEFAULT_LOCALE when none is supported.
+func negotiateLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		switch language {
+		case "pt":
+			return "pt-BR"
+		case "en":
+			return "en"
+		}
+	}
+	return defaultLocale
+}
+
+func localize(locale, code string, args ...any) string {
+	format, ok := messages[locale][code]
+	if !ok {
+		format = messages[fallbackLocale][code]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(format, args...)
+	}
+	return format
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestNegotiateLocale(t *testing.T) {
+	setForTest(t, &defaultLocale, "pt-BR")
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "pt-BR"},
+		{"en", "en"},
+		{"en-US,en;q=0.9", "en"},
+		{"pt-BR", "pt-BR"},
+		{"pt", "pt-BR"},
+		{"PT-br;q=0.8", "pt-BR"},
+		{"fr-FR, en;q=0.5", "en"},
+		{"de, fr", "pt-BR"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLocale(tt.acceptLanguage); got != tt.want {
+			t.Errorf("negotiateLocale(%q) = %q, want %q", tt.acceptLanguage, got, tt.want)
+		}
+	}
+
+	setForTest(t, &defaultLocale, "en")
+	if got := negotiateLocale("de"); got != "en" {
+		t.Errorf("with DEFAULT_LOCALE=en, negotiateLocale(%q) = %q, want en", "de", got)
+	}
+}
+
+func TestMessageCatalogsMatch(t *testing.T) {
+	for code := range messages[fallbackLocale] {
+		if _, ok := messages["pt-BR"][code]; !ok {
+			t.Errorf("pt-BR has no message for %q", code)
+		}
+	}
+	for code := range messages["pt-BR"] {
+		if _, ok := messages[fallbackLocale][code]; !ok {
+			t.Errorf("en has no message for %q", code)
+		}
+	}
+}
+
+func TestHandlerCepErrorLocale(t *testing.T) {
+	setForTest(t, &defaultLocale, "pt-BR")
+	tests := []struct {
+		acceptLanguage string
+		wantMessage    string
+	}{
+		{acceptLanguage: "en-US", wantMessage: "invalid zipcode"},
+		{acceptLanguage: "pt-BR", wantMessage: "CEP inválido"},
+		{acceptLanguage: "", wantMessage: "CEP inválido"},
+	}
+	router := chi.NewRouter()
+	router.Get("/{cep}", HandlerCep)
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/123", nil)
+		if tt.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var body ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Accept-Language %q: decoding %s: %s", tt.acceptLanguage, rec.Body, err)
+		}
+		// The code and the legacy error field stay the same whatever the language.
+		if body.Code != codeInvalidZipcode || body.Error != "invalid zipcode" || body.Message != tt.wantMessage {
+			t.Errorf("Accept-Language %q: body = %+v, want code %q and message %q", tt.acceptLanguage, body, codeInvalidZipcode, tt.wantMessage)
+		}
+	}
+}
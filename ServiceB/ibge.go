@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var validIbgeRegex = regexp.MustCompile(`^\d{7}$`)
+
+// errIbgeCodeNotFound means IBGE has no municipality under the code. It is the only failure
+// reported as 404; everything else on the way to the weather is ours or an upstream's.
+var errIbgeCodeNotFound = errors.New("ibge code not found")
+
+type IbgeUF struct {
+	Sigla string `json:"sigla"`
+	Nome  string `json:"nome"`
+}
+
+type IbgeMesorregiao struct {
+	UF IbgeUF `json:"UF"`
+}
+
+type IbgeMicrorregiao struct {
+	Mesorregiao IbgeMesorregiao `json:"mesorregiao"`
+}
+
+type IbgeRegiaoIntermediaria struct {
+	UF IbgeUF `json:"UF"`
+}
+
+type IbgeRegiaoImediata struct {
+	RegiaoIntermediaria IbgeRegiaoIntermediaria `json:"regiao-intermediaria"`
+}
+
+type IbgeMunicipioResponse struct {
+	ID             int                 `json:"id"`
+	Nome           string              `json:"nome"`
+	Microrregiao   *IbgeMicrorregiao   `json:"microrregiao"`
+	RegiaoImediata *IbgeRegiaoImediata `json:"regiao-imediata"`
+}
+
+// UF returns the municipality's state. A few recently created municipalities have no
+// microrregiao, so the newer regiao-imediata hierarchy is preferred.
+func (m *IbgeMunicipioResponse) UF() IbgeUF {
+	if m.RegiaoImediata != nil {
+		return m.RegiaoImediata.RegiaoIntermediaria.UF
+	}
+	if m.Microrregiao != nil {
+		return m.Microrregiao.Mesorregiao.UF
+	}
+	return IbgeUF{}
+}
+
+// HandlerIbge returns the current temperature for a municipality identified by its IBGE code.
+func HandlerIbge(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "HandlerIbge")
+	defer span.End()
+
+	code := chi.URLParam(r, "code")
+	if !validIbgeRegex.MatchString(code) {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidIbgeCode)
+		return
+	}
+
+	municipio, err := IbgeMunicipio(ctx, code)
+	if err != nil {
+		writeIbgeError(w, r, err)
+		return
+	}
+
+	location, err := GeocodeCity(ctx, municipio.Nome, municipio.UF().Nome)
+	if err != nil {
+		writeIbgeError(w, r, err)
+		return
+	}
+
+	weatherResponse, _, _, err := LookupWeather(ctx,
+		strconv.FormatFloat(location.Latitude, 'f', -1, 64),
+		strconv.FormatFloat(location.Longitude, 'f', -1, 64),
+		"",
+	)
+	if err != nil {
+		writeIbgeError(w, r, err)
+		return
+	}
+
+	writeData(w, r, http.StatusOK, newTemperature(municipio.Nome, weatherResponse.Current.Temperature2M), sourceUpstream)
+}
+
+func writeIbgeError(w http.ResponseWriter, r *http.Request, err error) {
+	var upErr *upstreamError
+	switch {
+	case errors.Is(err, errIbgeCodeNotFound):
+		writeError(w, r, http.StatusNotFound, codeIbgeCodeNotFound)
+	case errors.As(err, &upErr):
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError)
+	case errors.Is(err, errGeocoderBusy):
+		writeError(w, r, http.StatusServiceUnavailable, codeOverloaded)
+	case timedOut(err):
+		writeError(w, r, http.StatusGatewayTimeout, codeUpstreamTimeout)
+	case errors.Is(err, errCityNotFound) || weatherUnavailable(err):
+		// The municipality exists; it is its coordinates or its weather we can't get.
+		writeError(w, r, http.StatusUnprocessableEntity, codeWeatherUnavailable)
+	default:
+		writeError(w, r, http.StatusBadGateway, codeUpstreamError)
+	}
+}
+
+func IbgeMunicipio(ctx context.Context, code string) (*IbgeMunicipioResponse, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "IbgeMunicipio")
+	defer span.End()
+
+	url := ibgeBaseURL + "/api/v1/localidades/municipios/" + code
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "ibge"), "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("ibge", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("ibge", resp, body, fmt.Errorf("ibge api returned %d", resp.StatusCode))
+	}
+	// Unknown codes come back as 200 with an empty array instead of a 404.
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		return nil, errIbgeCodeNotFound
+	}
+
+	var municipio IbgeMunicipioResponse
+	if err := decodeUpstreamJSON("ibge", resp, body, &municipio); err != nil {
+		return nil, err
+	}
+
+	if municipio.Nome == "" {
+		return nil, errIbgeCodeNotFound
+	}
+	return &municipio, nil
+}
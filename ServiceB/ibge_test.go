@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestHandlerIbgeErrors(t *testing.T) {
+	municipios := map[string]string{
+		"3550308": `{"id":3550308,"nome":"São Paulo","regiao-imediata":{"regiao-intermediaria":{"UF":{"sigla":"SP","nome":"São Paulo"}}}}`,
+		"1111111": `{"id":1111111,"nome":"Lugar Nenhum","regiao-imediata":{"regiao-intermediaria":{"UF":{"sigla":"SP","nome":"São Paulo"}}}}`,
+		"9999999": `[]`,
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api/v1/localidades/municipios/"):
+			body, ok := municipios[strings.TrimPrefix(r.URL.Path, "/api/v1/localidades/municipios/")]
+			if !ok {
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(body))
+		case r.URL.Path == "/v1/search":
+			results := []GeocodingResult{}
+			if r.URL.Query().Get("name") == "São Paulo" {
+				results = append(results, GeocodingResult{Name: "São Paulo", Latitude: -23.55, Longitude: -46.63, CountryCode: "BR", Admin1: "São Paulo"})
+			}
+			json.NewEncoder(w).Encode(GeocodingResponse{Results: results})
+		case r.URL.Path == "/v1/forecast":
+			body, _ := os.ReadFile("testdata/fixtures/success/openmeteo.json")
+			w.Write(body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	router := chi.NewRouter()
+	router.Get("/ibge/{code}", HandlerIbge)
+
+	tests := []struct {
+		name       string
+		code       string
+		ibgeURL    string
+		geocoder   Geocoder
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "found", code: "3550308", wantStatus: http.StatusOK},
+		{name: "unknown code", code: "9999999", wantStatus: http.StatusNotFound, wantCode: codeIbgeCodeNotFound},
+		{name: "ibge failing", code: "5000000", wantStatus: http.StatusBadGateway, wantCode: codeUpstreamError},
+		{name: "ibge unreachable", code: "3550308", ibgeURL: closed.URL, wantStatus: http.StatusBadGateway, wantCode: codeUpstreamError},
+		{name: "city not geocoded", code: "1111111", wantStatus: http.StatusUnprocessableEntity, wantCode: codeWeatherUnavailable},
+		{name: "geocoder busy", code: "3550308", geocoder: failingGeocoder{errGeocoderBusy}, wantStatus: http.StatusServiceUnavailable, wantCode: codeOverloaded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateUpstreams(t)
+			setForTest(t, &openMeteoBaseURL, upstream.URL)
+			setForTest(t, &openMeteoGeocodeBaseURL, upstream.URL)
+			setForTest(t, &ibgeBaseURL, cmp.Or(tt.ibgeURL, upstream.URL))
+			setForTest(t, &geocoder, cmp.Or[Geocoder](tt.geocoder, openMeteoGeocoder{}))
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ibge/"+tt.code, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"`+tt.wantCode+`"`) {
+				t.Errorf("body %s lacks code %q", rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
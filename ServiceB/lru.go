@@ -0,0 +1,74 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// negativeLRU remembers keys known not to resolve, each for a TTL, holding at most maxEntries:
+// when full, the least recently seen key goes first. Lookups are counted in
+// cache_lookups_total as negative_hit or miss under name.
+type negativeLRU struct {
+	name       string
+	maxEntries int
+
+	mu    sync.Mutex
+	order *list.List // front is the most recently used; elements hold *negativeEntry
+	keys  map[string]*list.Element
+}
+
+type negativeEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+func newNegativeLRU(name string, maxEntries int) *negativeLRU {
+	return &negativeLRU{
+		name:       name,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		keys:       make(map[string]*list.Element),
+	}
+}
+
+// Contains reports whether key is a live negative entry, refreshing its recency if so.
+func (c *negativeLRU) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.keys[key]
+	if ok && time.Now().After(elem.Value.(*negativeEntry).expiresAt) {
+		c.removeLocked(elem)
+		ok = false
+	}
+	if !ok {
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "miss").Inc()
+		return false
+	}
+	c.order.MoveToFront(elem)
+	cacheLookups.WithLabelValues(labelValue("cache", c.name), "negative_hit").Inc()
+	return true
+}
+
+// Add records key as not resolving for ttl, evicting the least recently used key if full.
+func (c *negativeLRU) Add(key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(jitterTTL(ttl, cacheTTLJitter))
+	if elem, ok := c.keys[key]; ok {
+		elem.Value.(*negativeEntry).expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.maxEntries {
+		c.removeLocked(c.order.Back())
+	}
+	c.keys[key] = c.order.PushFront(&negativeEntry{key: key, expiresAt: expiresAt})
+}
+
+func (c *negativeLRU) removeLocked(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.keys, elem.Value.(*negativeEntry).key)
+}
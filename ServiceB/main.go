@@ -1,33 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/adrianodevfullstack/lab02.git/temperature"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
-var validCepRegex = regexp.MustCompile(`^\d{8}$`)
-
 type CepAwesomeapiResponse struct {
 	Cep         string `json:"cep"`
 	AddressType string `json:"address_type"`
@@ -40,18 +42,47 @@ type CepAwesomeapiResponse struct {
 	City        string `json:"city"`
 	Ibge        string `json:"city_ibge"`
 	Ddd         string `json:"ddd"`
+	// Alternates are the other records of a multi-record response; see primaryCepRecord.
+	Alternates []CepAwesomeapiResponse `json:"alternates,omitempty"`
 }
 
 type CurrentUnits struct {
-	Time          string `json:"time"`
-	Interval      string `json:"interval"`
-	Temperature2M string `json:"temperature_2m"`
+	Time                string `json:"time"`
+	Interval            string `json:"interval"`
+	Temperature2M       string `json:"temperature_2m"`
+	ApparentTemperature string `json:"apparent_temperature"`
 }
 
 type Current struct {
-	Time          string  `json:"time"`
-	Interval      int     `json:"interval"`
-	Temperature2M float64 `json:"temperature_2m"`
+	Time                string   `json:"time"`
+	Interval            int      `json:"interval"`
+	Temperature2M       float64  `json:"temperature_2m"`
+	ApparentTemperature *float64 `json:"apparent_temperature"`
+	RelativeHumidity2M  *float64 `json:"relative_humidity_2m,omitempty"`
+	WindSpeed10M        *float64 `json:"wind_speed_10m,omitempty"`
+	// Extra holds the WEATHER_CURRENT_VARS values the provider reported.
+	Extra map[string]float64 `json:"extra,omitempty"`
+}
+
+// Optional open-meteo "current" variables, requested only when a client includes them.
+const (
+	weatherVarHumidity  = "relative_humidity_2m"
+	weatherVarWindSpeed = "wind_speed_10m"
+)
+
+// Optional open-meteo "daily" variables. They go in daily= instead of current=, and asking for
+// any also asks for timezone=auto, so days and times are local to the location.
+const (
+	weatherVarSunrise = "sunrise"
+	weatherVarSunset  = "sunset"
+)
+
+// Daily holds today's daily variables when any were requested. Values open-meteo has none for
+// (e.g. sunrise during polar night) are null and decode as "".
+type Daily struct {
+	Time    []string `json:"time"`
+	Sunrise []string `json:"sunrise,omitempty"`
+	Sunset  []string `json:"sunset,omitempty"`
 }
 
 type WeatherApiResponse struct {
@@ -64,16 +95,114 @@ type WeatherApiResponse struct {
 	Elevation            float64      `json:"elevation"`
 	CurrentUnits         CurrentUnits `json:"current_units"`
 	Current              Current      `json:"current"`
+	Daily                *Daily       `json:"daily,omitempty"`
+}
+
+// SunTimes returns today's sunrise and sunset at the response's UTC offset, each nil when the
+// response doesn't have it.
+func (w *WeatherApiResponse) SunTimes() (sunrise, sunset *jsonTime) {
+	if w.Daily == nil {
+		return nil, nil
+	}
+	zone := time.FixedZone(w.TimezoneAbbreviation, w.UtcOffsetSeconds)
+	parse := func(values []string) *jsonTime {
+		if len(values) == 0 {
+			return nil
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04", values[0], zone)
+		if err != nil {
+			return nil
+		}
+		return newJSONTime(t)
+	}
+	return parse(w.Daily.Sunrise), parse(w.Daily.Sunset)
+}
+
+// ObservedAt is when the current conditions were measured. Current.Time is local to the
+// response's timezone, without an offset of its own.
+func (w *WeatherApiResponse) ObservedAt() (time.Time, bool) {
+	observed, err := time.Parse("2006-01-02T15:04", w.Current.Time)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return observed.Add(-time.Duration(w.UtcOffsetSeconds) * time.Second), true
+}
+
+type Address struct {
+	Cep        string    `json:"cep"`
+	Address    string    `json:"address"`
+	District   string    `json:"district"`
+	City       string    `json:"city"`
+	State      string    `json:"state"`
+	Alternates []Address `json:"alternates,omitempty"`
+}
+
+func newAddress(cepResponse *CepAwesomeapiResponse) Address {
+	address := Address{
+		Cep:      cepResponse.Cep,
+		Address:  cepResponse.Address,
+		District: cepResponse.District,
+		City:     cepResponse.City,
+		State:    cepResponse.State,
+	}
+	for _, alternate := range cepResponse.Alternates {
+		address.Alternates = append(address.Alternates, newAddress(&alternate))
+	}
+	return address
+}
+
+type WeatherMeta struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Elevation float64 `json:"elevation"`
+	Provider  string  `json:"provider"`
+	// Model is the open-meteo model the weather came from; empty when another provider served it.
+	Model    string `json:"model,omitempty"`
+	Degraded bool   `json:"degraded"`
 }
 
 type Temperature struct {
+	City       string   `json:"city"`
+	TempC      float64  `json:"temp_C"`
+	TempF      float64  `json:"temp_F"`
+	TempK      float64  `json:"temp_K"`
+	FeelsLikeC *float64 `json:"feels_like_C,omitempty"`
+	FeelsLikeF *float64 `json:"feels_like_F,omitempty"`
+	FeelsLikeK *float64 `json:"feels_like_K,omitempty"`
+	Humidity   *float64 `json:"humidity,omitempty"`
+	WindKmh    *float64 `json:"wind_kmh,omitempty"`
+	// Sunrise and Sunset are today's, at the location's UTC offset, for ?include=sun.
+	Sunrise *jsonTime `json:"sunrise,omitempty"`
+	Sunset  *jsonTime `json:"sunset,omitempty"`
+	// Ddd is the CEP's area code, for ?include=ddd; left out when the provider's is malformed.
+	Ddd *AreaCode `json:"ddd,omitempty"`
+	// Current carries the WEATHER_CURRENT_VARS values, keyed by open-meteo variable name.
+	Current map[string]float64 `json:"current,omitempty"`
+	// Approximate is set when the weather is for the city center rather than the CEP itself.
+	Approximate bool         `json:"approximate,omitempty"`
+	Meta        *WeatherMeta `json:"meta,omitempty"`
+	Debug       *DebugInfo   `json:"debug,omitempty"`
+}
+
+// RawTemperature is the ?raw=true response: the measured Celsius value without conversions.
+type RawTemperature struct {
 	City  string  `json:"city"`
 	TempC float64 `json:"temp_C"`
-	TempF float64 `json:"temp_F"`
-	TempK float64 `json:"temp_K"`
 }
 
-func initProvider() (func(context.Context) error, error) {
+// DebugInfo carries the parsed upstream payloads behind ?include=raw (DEBUG_ENDPOINTS only).
+type DebugInfo struct {
+	Cep     *CepAwesomeapiResponse `json:"cep"`
+	Weather *WeatherApiResponse    `json:"weather"`
+}
+
+// telemetry is what initProvider sets up, kept so shutdown can tear it down in order.
+type telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	conn           *grpc.ClientConn
+}
+
+func initProvider() (*telemetry, error) {
 	ctx := context.Background()
 
 	res, err := resource.New(ctx,
@@ -86,70 +215,137 @@ func initProvider() (func(context.Context) error, error) {
 	}
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	conn, err := grpc.NewClient("otel-collector:4317", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := newCollectorConn(collectorEndpoints)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC connection to collector: %w", err)
 	}
 
 	traceExporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
 	}
 
-	bsp := sdktrace.NewBatchSpanProcessor(traceExporter)
+	var processor sdktrace.SpanProcessor
+	if syncSpans {
+		log.Println("SYNC_SPANS=true: exporting spans synchronously, not for production")
+		processor = sdktrace.NewSimpleSpanProcessor(traceExporter)
+	} else {
+		processor = sdktrace.NewBatchSpanProcessor(traceExporter)
+	}
 	tracerProvider := sdktrace.NewTracerProvider(
 		sdktrace.WithSampler(sdktrace.AlwaysSample()),
 		sdktrace.WithResource(res),
-		sdktrace.WithSpanProcessor(bsp),
+		sdktrace.WithSpanProcessor(processor),
 	)
 	otel.SetTracerProvider(tracerProvider)
+	otel.SetErrorHandler(&telemetryErrorHandler{})
 
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
-	return tracerProvider.Shutdown, nil
+	return &telemetry{tracerProvider: tracerProvider, conn: conn}, nil
 }
 
 func main() {
+	if configFileErr != nil {
+		log.Fatalf("CONFIG_FILE: %s", configFileErr)
+	}
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, shutdownSignals...)
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), shutdownSignals...)
 	defer cancel()
 
-	shutdown, err := initProvider()
+	tel, err := initProvider()
 	if err != nil {
-		log.Fatal(err)
-	}
-	defer func() {
-		if err := shutdown(ctx); err != nil {
-			log.Printf("failed to shutdown TracerProvider: %s", err)
+		if tracingRequired {
+			log.Fatal(err)
 		}
-	}()
+		// Serve traffic without tracing rather than letting a collector outage take the API
+		// down. Incoming trace context is still propagated to downstream calls.
+		log.Printf("WARNING: tracing disabled: %s", err)
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	}
 
+	// middleware.RequestID reuses an incoming ID from this header and generates one otherwise.
+	middleware.RequestIDHeader = requestIDHeader
 	router := chi.NewRouter()
+	router.Use(StaticHeaders(responseHeaders))
 
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
+	router.Use(RequestLogger)
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(60 * time.Second))
-	// promhttp
-	router.Handle("/metrics", promhttp.Handler())
-	router.Get("/{cep}", HandlerCep)
+	router.Use(RejectWhenShuttingDown("/metrics"))
+	router.Use(LoadShedder(int64(loadShedHighWater), "/metrics", "/status"))
+	router.Use(RequestTimeout(requestTimeout, maxRequestTimeout))
+	if debugEndpoints {
+		router.Use(InjectDelay(debugMaxDelay))
+	}
+	router.With(RequireToken(metricsAuthToken, "metrics")).Handle("/metrics", metricsHandler(metricsRegistry))
+	checks := []dependencyCheck{
+		{name: "otel-collector", check: anyTCPCheck(collectorEndpoints)},
+		{name: "awesomeapi", check: httpCheck(awesomeapiBaseURL + "/")},
+		{name: "viacep", check: httpCheck(viacepBaseURL + "/")},
+	}
+	if weatherEnabled {
+		checks = append(checks, dependencyCheck{name: "openmeteo", check: httpCheck(openMeteoBaseURL + "/")})
+	}
+	status := newStatusMonitor(checks...)
+	go status.Run(ctx, statusCheckInterval)
+	router.Get("/status", status.Handler)
+	// Every API route lists the query parameters it reads for queryParams; /status and
+	// /metrics stay lenient for scrapers.
+	cepRoutes := router.With()
+	if canonicalRedirect {
+		cepRoutes = router.With(CanonicalCepRedirect)
+	}
+	cepRoutes.With(queryParams()).Get("/{cep}/address", HandlerAddress)
+	if weatherEnabled {
+		cepRoutes.With(queryParams("include", "fields", "model", "raw", "empty", "suggest")).Get("/{cep}", HandlerCep)
+		cepRoutes.With(queryParams("from", "to")).Get("/{cep}/stats", HandlerStats)
+		cepRoutes.With(queryParams("days")).Get("/{cep}/forecast", HandlerForecast)
+		router.With(queryParams()).Get("/ibge/{code}", HandlerIbge)
+		router.With(queryParams()).Post("/average", HandlerAverage)
+	} else {
+		// Address-only deployment: no weather provider is ever called, and the endpoints that
+		// only make sense with weather aren't mounted.
+		log.Println("WEATHER_ENABLED=false: serving addresses only")
+		cepRoutes.With(queryParams()).Get("/{cep}", HandlerAddress)
+	}
+	if adminToken != "" {
+		router.Route("/admin", func(r chi.Router) {
+			r.Use(RequireToken(adminToken, "admin"))
+			r.Get("/config", HandlerGetConfig)
+			r.Post("/config", HandlerUpdateConfig)
+			r.Post("/warmup", HandlerStartWarmup)
+			r.Get("/warmup/{id}", HandlerGetWarmup)
+			r.Get("/cache/export", HandlerExportCache)
+			r.Post("/cache/import", HandlerImportCache)
+		})
+	}
+
+	srv := &http.Server{Addr: ":8090", Handler: router}
+	conns := trackConnections(srv)
 
 	go func() {
-		log.Println("Starting server on port 8090")
-		if err := http.ListenAndServe(":8090", router); err != nil {
+		log.Printf("Starting server on port 8090, graceful shutdown on %v", shutdownSignals)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
 		}
 	}()
 
 	select {
-	case <-sigCh:
-		log.Println("Shutting down gracefully, CTRL+C pressed...")
+	case sig := <-sigCh:
+		log.Printf("Shutting down gracefully, received %s...", sig)
 	case <-ctx.Done():
 		log.Println("Shutting down due to other reason...")
 	}
+
+	shutdownSequence(srv, conns, tel)
 }
 
 func HandlerCep(w http.ResponseWriter, r *http.Request) {
@@ -161,37 +357,253 @@ func HandlerCep(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(ctx, "HandlerCep")
 	defer span.End()
 
-	cep := chi.URLParam(r, "cep")
-	if cep == "" || !validCepRegex.MatchString(cep) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid zipcode"})
+	includes, unknownIncludes := parseInclude(r)
+	if len(unknownIncludes) > 0 {
+		recordCepRequest(http.StatusUnprocessableEntity, sourceNone)
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidInclude, strings.Join(unknownIncludes, ", "))
+		return
+	}
+	fields, unknownFields := parseFields(r)
+	if len(unknownFields) > 0 {
+		recordCepRequest(http.StatusUnprocessableEntity, sourceNone)
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidFields, strings.Join(unknownFields, ", "))
+		return
+	}
+
+	cep, err := parseCep(chi.URLParam(r, "cep"))
+	if err != nil {
+		recordCepRequest(http.StatusUnprocessableEntity, sourceNone)
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidZipcode)
+		return
+	}
+
+	model, ok := parseWeatherModel(r)
+	if !ok {
+		recordCepRequest(http.StatusUnprocessableEntity, sourceNone)
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidModel, r.URL.Query().Get("model"))
+		return
+	}
+
+	lookup, err := fetchWeatherForCep(ctx, cep, model, weatherVariables(includes)...)
+	if err != nil {
+		// ?empty=204 tells "the CEP exists but has no weather" apart from a CEP that doesn't.
+		if r.URL.Query().Get("empty") == "204" && weatherUnavailable(err) {
+			recordCepRequest(http.StatusNoContent, sourceNone)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		status, _ := lookupErrorCode(err)
+		recordCepRequest(status, sourceNone)
+		// Suggestions cost extra upstream calls, so they're opt-in.
+		if suggest, _ := strconv.ParseBool(r.URL.Query().Get("suggest")); suggest && errors.Is(err, errCepNotFound) {
+			writeNotFoundWithSuggestions(ctx, w, r, cep)
+			return
+		}
+		writeLookupError(w, r, err)
+		return
+	}
+
+	if observedAt, ok := lookup.Weather.ObservedAt(); ok && checkNotModified(w, r, observedAt) {
+		recordCepRequest(http.StatusNotModified, lookup.Source)
+		return
+	}
+
+	// ?raw=true is for clients that convert units themselves: Celsius as measured, nothing else.
+	if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+		recordCepRequest(http.StatusOK, lookup.Source)
+		writeData(w, r, http.StatusOK, RawTemperature{City: lookup.Cep.City, TempC: lookup.Weather.Current.Temperature2M}, lookup.Source)
+		return
+	}
+
+	result := newTemperature(lookup.Cep.City, lookup.Weather.Current.Temperature2M)
+	result.Approximate = lookup.Approximate
+	// Not every grid cell reports apparent_temperature; leave the fields out when it's missing.
+	if apparent := lookup.Weather.Current.ApparentTemperature; includes["feelslike"] && apparent != nil {
+		feelsLike := temperature.FromCelsius(*apparent)
+		result.FeelsLikeC, result.FeelsLikeF, result.FeelsLikeK = &feelsLike.TempC, &feelsLike.TempF, &feelsLike.TempK
+	}
+	// open-meteo resolves coordinates to its model grid cell, which may differ from the CEP's.
+	if includes["meta"] {
+		result.Meta = &WeatherMeta{
+			Latitude:  lookup.Weather.Latitude,
+			Longitude: lookup.Weather.Longitude,
+			Elevation: lookup.Weather.Elevation,
+			Provider:  lookup.WeatherProvider,
+			Degraded:  lookup.Degraded,
+		}
+		if lookup.WeatherProvider == "openmeteo" {
+			result.Meta.Model = cmp.Or(model, "best_match")
+		}
+	}
+	// Providers that don't report a variable leave it nil, and the field is omitted.
+	if includes["humidity"] {
+		result.Humidity = lookup.Weather.Current.RelativeHumidity2M
+	}
+	if includes["wind"] {
+		result.WindKmh = lookup.Weather.Current.WindSpeed10M
+	}
+	if includes["sun"] {
+		result.Sunrise, result.Sunset = lookup.Weather.SunTimes()
+	}
+	if includes["ddd"] {
+		result.Ddd = newAreaCode(lookup.Cep.Ddd)
+	}
+	result.Current = lookup.Weather.Current.Extra
+	if includes["raw"] && debugEndpoints {
+		result.Debug = &DebugInfo{Cep: lookup.Cep, Weather: lookup.Weather}
+	}
+
+	recordCepRequest(http.StatusOK, lookup.Source)
+	if fields != nil {
+		subset, err := selectFields(result, fields)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, codeInternalError)
+			return
+		}
+		writeData(w, r, http.StatusOK, subset, lookup.Source)
 		return
 	}
+	writeData(w, r, http.StatusOK, result, lookup.Source)
+}
 
-	cepResponse, err := CepAwesomeapi(ctx, cep)
+// weatherLookup is a CEP resolved to its address and current weather.
+type weatherLookup struct {
+	Cep     *CepAwesomeapiResponse
+	Weather *WeatherApiResponse
+	// Source says whether the address came from the cache or an upstream provider.
+	Source dataSource
+	// WeatherProvider served the weather; Degraded means it was a fallback provider.
+	WeatherProvider string
+	Degraded        bool
+	// Approximate means the provider's coordinates were implausible and the city center was used.
+	Approximate bool
+}
+
+// fetchWeatherForCep resolves a validated CEP to its address and current weather from model
+// ("" for open-meteo's best match), including any extra weather variables asked for.
+func fetchWeatherForCep(ctx context.Context, cep, model string, vars ...string) (*weatherLookup, error) {
+	cepResponse, source, err := LookupCepLocation(ctx, cep)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "can not find zipcode"})
+		return nil, err
+	}
+
+	latitude, longitude, approximate, err := weatherCoordinates(ctx, cepResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	weatherResponse, provider, degraded, err := LookupWeather(ctx, latitude, longitude, model, vars...)
+	if err != nil {
+		return nil, err
+	}
+	return &weatherLookup{
+		Cep:             cepResponse,
+		Weather:         weatherResponse,
+		Source:          source,
+		WeatherProvider: provider,
+		Degraded:        degraded,
+		Approximate:     approximate,
+	}, nil
+}
+
+// lookupErrorCode classifies a lookup failure: 502 when an upstream misbehaved, 504 when the
+// lookup ran out of time or was canceled, 422 when the location has no weather coverage or no
+// usable coordinates, 404 otherwise.
+func lookupErrorCode(err error) (int, string) {
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return http.StatusBadGateway, codeUpstreamError
+	}
+	if errors.Is(err, errCepRateLimited) || errors.Is(err, errGeocoderBusy) {
+		return http.StatusServiceUnavailable, codeOverloaded
+	}
+	if timedOut(err) {
+		return http.StatusGatewayTimeout, codeUpstreamTimeout
+	}
+	if errors.Is(err, errNoWeatherCoverage) || errors.Is(err, errNoCoordinates) {
+		return http.StatusUnprocessableEntity, codeWeatherUnavailable
+	}
+	return http.StatusNotFound, codeZipcodeNotFound
+}
+
+func writeLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := lookupErrorCode(err)
+	if errors.Is(err, errCepRateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(int((cepRateLimitInterval+time.Second-1)/time.Second)))
+	}
+	writeError(w, r, status, code)
+}
+
+func newTemperature(city string, tempC float64) Temperature {
+	t := temperature.FromCelsius(tempC)
+	return Temperature{City: city, TempC: t.TempC, TempF: t.TempF, TempK: t.TempK}
+}
+
+// HandlerAddress resolves a CEP to its address only, skipping the weather lookup.
+func HandlerAddress(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "HandlerAddress")
+	defer span.End()
+
+	cep, err := parseCep(chi.URLParam(r, "cep"))
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidZipcode)
 		return
 	}
 
-	weatherResponse, err := WeatherApi(ctx, cepResponse.Latitude, cepResponse.Longitude)
+	cepResponse, source, err := LookupCep(ctx, cep)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "can not find zipcode"})
+		writeLookupError(w, r, err)
 		return
 	}
+	if weatherPrefetch && weatherEnabled && source == sourceCache {
+		prefetcher.Prefetch(ctx, cepResponse)
+	}
+
+	writeJSON(w, r, http.StatusOK, newAddress(cepResponse))
+}
+
+// knownIncludes are the optional sections GET /{cep} can add to its response.
+var knownIncludes = map[string]bool{
+	"meta": true, "raw": true, "feelslike": true, "humidity": true, "wind": true, "ddd": true, "sun": true,
+}
 
-	tempC := weatherResponse.Current.Temperature2M
-	result := Temperature{
-		City:  cepResponse.City,
-		TempC: tempC,
-		TempF: tempC*1.8 + 32,
-		TempK: tempC + 273.15,
+// parseInclude collects the optional sections requested via ?include=a,b (or repeated include
+// params), along with any values that aren't known sections.
+func parseInclude(r *http.Request) (includes map[string]bool, unknown []string) {
+	includes = make(map[string]bool)
+	for _, value := range r.URL.Query()["include"] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			if !knownIncludes[item] {
+				unknown = append(unknown, item)
+				continue
+			}
+			includes[item] = true
+		}
 	}
+	return includes, unknown
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(result)
+// weatherVariables maps includes to the extra weather variables they need from the provider.
+func weatherVariables(includes map[string]bool) []string {
+	var vars []string
+	if includes["humidity"] {
+		vars = append(vars, weatherVarHumidity)
+	}
+	if includes["wind"] {
+		vars = append(vars, weatherVarWindSpeed)
+	}
+	if includes["sun"] {
+		vars = append(vars, weatherVarSunrise, weatherVarSunset)
+	}
+	return vars
 }
 
 func CepAwesomeapi(ctx context.Context, cep string) (*CepAwesomeapiResponse, error) {
@@ -199,79 +611,127 @@ func CepAwesomeapi(ctx context.Context, cep string) (*CepAwesomeapiResponse, err
 	ctx, span := tracer.Start(ctx, "CepAwesomeapi")
 	defer span.End()
 
-	url := "https://cep.awesomeapi.com.br/json/" + cep
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	url := awesomeapiBaseURL + "/json/" + url.PathEscape(cep)
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "awesomeapi"), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readUpstreamBody("awesomeapi", resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("cep not found")
+		return nil, errCepNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("cep api returned %d", resp.StatusCode)
+		return nil, newUpstreamError("awesomeapi", resp, body, fmt.Errorf("cep api returned %d", resp.StatusCode))
+	}
+
+	// For a "CEP único" (one CEP for a whole town) awesomeapi may answer with an array of
+	// records instead of a single object.
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []CepAwesomeapiResponse
+		if err := decodeUpstreamJSON("awesomeapi", resp, body, &records); err != nil {
+			return nil, err
+		}
+		return primaryCepRecord(records)
 	}
 
 	var cepResponse CepAwesomeapiResponse
-	if err := json.Unmarshal(body, &cepResponse); err != nil {
+	if err := decodeUpstreamJSON("awesomeapi", resp, body, &cepResponse); err != nil {
 		return nil, err
 	}
 
 	if cepResponse.Cep == "" {
-		return nil, fmt.Errorf("cep not found")
+		return nil, errCepNotFound
 	}
 	return &cepResponse, nil
 }
 
-func WeatherApi(ctx context.Context, latitude, longitude string) (*WeatherApiResponse, error) {
+// primaryCepRecord picks the record to answer with from a multi-record response: the first
+// one with coordinates, since the weather lookup needs them, or else the first one at all.
+// The remaining records are kept as its alternates.
+func primaryCepRecord(records []CepAwesomeapiResponse) (*CepAwesomeapiResponse, error) {
+	records = slices.DeleteFunc(records, func(record CepAwesomeapiResponse) bool { return record.Cep == "" })
+	if len(records) == 0 {
+		return nil, errCepNotFound
+	}
+
+	primary := 0
+	if i := slices.IndexFunc(records, func(record CepAwesomeapiResponse) bool {
+		return record.Latitude != "" && record.Longitude != ""
+	}); i >= 0 {
+		primary = i
+	}
+	result := records[primary]
+	result.Alternates = slices.Delete(slices.Clone(records), primary, primary+1)
+	return &result, nil
+}
+
+func WeatherApi(ctx context.Context, latitude, longitude, model string, vars ...string) (*WeatherApiResponse, error) {
 	tracer := otel.Tracer("microservice-tracer")
 	ctx, span := tracer.Start(ctx, "WeatherApi")
 	defer span.End()
 
 	if _, err := strconv.ParseFloat(latitude, 64); err != nil {
-		return nil, fmt.Errorf("invalid coordinates: %w", err)
+		return nil, fmt.Errorf("%w: %w", errInvalidCoordinates, err)
 	}
 	if _, err := strconv.ParseFloat(longitude, 64); err != nil {
-		return nil, fmt.Errorf("invalid coordinates: %w", err)
+		return nil, fmt.Errorf("%w: %w", errInvalidCoordinates, err)
 	}
 
-	url := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%s&longitude=%s&current=temperature_2m", latitude, longitude)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	url := fmt.Sprintf("%s/v1/forecast?latitude=%s&longitude=%s&current=%s", openMeteoBaseURL, latitude, longitude, currentVariables(vars))
+	if daily := dailyVariables(vars); daily != "" {
+		url += "&daily=" + daily + "&timezone=auto&forecast_days=1"
+	}
+	if model != "" {
+		url += "&models=" + model
+	}
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "openmeteo"), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := upstreamClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readUpstreamBody("openmeteo", resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("weather api returned %d", resp.StatusCode)
+		return nil, newUpstreamError("openmeteo", resp, body, fmt.Errorf("weather api returned %d", resp.StatusCode))
 	}
 
 	var weatherResponse WeatherApiResponse
-	if err := json.Unmarshal(body, &weatherResponse); err != nil {
+	if err := decodeUpstreamJSON("openmeteo", resp, body, &weatherResponse); err != nil {
 		return nil, err
 	}
+	// Without a time the "current" block is missing or partial, and its zero values would read
+	// as 0°C. Outside open-meteo's grid that's a coverage gap rather than a broken response.
+	if weatherResponse.Current.Time == "" {
+		if weatherCoverageCheck {
+			return nil, errNoWeatherCoverage
+		}
+		return nil, newUpstreamError("openmeteo", resp, body, errNoCurrentConditions)
+	}
+	if weatherResponse.CurrentUnits.Temperature2M == "" {
+		logFromCtx(ctx).Warn("open-meteo response has no current_units, assuming °C",
+			slog.String("latitude", latitude),
+			slog.String("longitude", longitude),
+		)
+	}
 	return &weatherResponse, nil
 }
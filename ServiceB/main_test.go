@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestCepAwesomeapiFixtures(t *testing.T) {
+	tests := []struct {
+		set        string
+		wantCity   string
+		wantErr    error
+		wantStatus int
+	}{
+		{set: "success", wantCity: "São Paulo"},
+		{set: "not_found", wantErr: errCepNotFound},
+		{set: "rate_limited", wantStatus: http.StatusTooManyRequests},
+		{set: "malformed", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.set, func(t *testing.T) {
+			newFixtureServer(t, tt.set)
+
+			got, err := CepAwesomeapi(context.Background(), "01001000")
+			switch {
+			case tt.wantCity != "":
+				if err != nil {
+					t.Fatalf("CepAwesomeapi: %s", err)
+				}
+				if got.City != tt.wantCity || got.Latitude != "-23.5502784" || got.Longitude != "-46.6342179" {
+					t.Errorf("got %+v", got)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			default:
+				var upErr *upstreamError
+				if !errors.As(err, &upErr) || upErr.StatusCode != tt.wantStatus {
+					t.Errorf("err = %v, want an upstream error with status %d", err, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestWeatherApiFixtures(t *testing.T) {
+	tests := []struct {
+		set        string
+		wantStatus int
+	}{
+		{set: "success"},
+		{set: "not_found", wantStatus: http.StatusBadRequest},
+		{set: "rate_limited", wantStatus: http.StatusTooManyRequests},
+		{set: "malformed", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.set, func(t *testing.T) {
+			newFixtureServer(t, tt.set)
+
+			got, err := WeatherApi(context.Background(), "-23.5502784", "-46.6342179", "")
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("WeatherApi: %s", err)
+				}
+				if got.Current.Temperature2M != 21.4 || got.Current.Interval != 900 {
+					t.Errorf("current = %+v", got.Current)
+				}
+				return
+			}
+			var upErr *upstreamError
+			if !errors.As(err, &upErr) || upErr.StatusCode != tt.wantStatus {
+				t.Errorf("err = %v, want an upstream error with status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHandlerCepFixtures(t *testing.T) {
+	tests := []struct {
+		set        string
+		wantStatus int
+		wantCode   string
+	}{
+		{set: "success", wantStatus: http.StatusOK},
+		{set: "not_found", wantStatus: http.StatusNotFound, wantCode: codeZipcodeNotFound},
+		{set: "rate_limited", wantStatus: http.StatusBadGateway, wantCode: codeUpstreamError},
+		{set: "malformed", wantStatus: http.StatusBadGateway, wantCode: codeUpstreamError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.set, func(t *testing.T) {
+			upstream := newFixtureServer(t, tt.set)
+
+			rec := serveCep(t, "/01001000")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				var body ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != tt.wantCode {
+					t.Errorf("body = %s, want code %q", rec.Body, tt.wantCode)
+				}
+				return
+			}
+
+			var got Temperature
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %s: %s", rec.Body, err)
+			}
+			if got.City != "São Paulo" || got.TempC != 21.4 || got.TempF != 70.52 {
+				t.Errorf("got %+v", got)
+			}
+
+			// The second request is served from the caches.
+			serveCep(t, "/01001000")
+			if n := upstream.Calls("/json/"); n != 1 {
+				t.Errorf("awesomeapi called %d times, want 1", n)
+			}
+			if n := upstream.Calls("/v1/forecast"); n != 1 {
+				t.Errorf("open-meteo called %d times, want 1", n)
+			}
+		})
+	}
+}
+
+// serveCep sends GET target to HandlerCep through a router that sets the {cep} parameter.
+func serveCep(t *testing.T, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	router := chi.NewRouter()
+	router.Get("/{cep}", HandlerCep)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestHandlerCepTimeoutIsNotNotFound(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+	// The lookup outlives the requests that gave up on it; let it finish before the caches are
+	// restored, so its answer can't reach a later test.
+	t.Cleanup(func() {
+		close(release)
+		for {
+			cepFlights.mu.Lock()
+			n := len(cepFlights.flights)
+			cepFlights.mu.Unlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	router := chi.NewRouter()
+	router.Get("/{cep}", HandlerCep)
+	for name, ctx := range map[string]func() (context.Context, context.CancelFunc){
+		"deadline": func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		},
+		"canceled": func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := ctx()
+			defer cancel()
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/01001000", nil))
+			var body ErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if rec.Code != http.StatusGatewayTimeout || body.Code != codeUpstreamTimeout {
+				t.Errorf("status = %d, code %q, want 504 %q", rec.Code, body.Code, codeUpstreamTimeout)
+			}
+		})
+	}
+}
+
+func TestHandlerCepPadding(t *testing.T) {
+	tests := []struct {
+		pad        bool
+		target     string
+		wantStatus int
+	}{
+		{pad: true, target: "/1001000", wantStatus: http.StatusOK},
+		{pad: true, target: "/101001000", wantStatus: http.StatusUnprocessableEntity},
+		{pad: true, target: "/100100a", wantStatus: http.StatusUnprocessableEntity},
+		{pad: false, target: "/1001000", wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		upstream := newFixtureServer(t, "success")
+		setForTest(t, &padCep, tt.pad)
+		setForTest(t, &cepParser, newCepParser(""))
+
+		rec := serveCep(t, tt.target)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("PAD_CEP=%v GET %s: status = %d, want %d: %s", tt.pad, tt.target, rec.Code, tt.wantStatus, rec.Body)
+		}
+		if paths := upstream.Paths(); tt.wantStatus == http.StatusOK && (len(paths) == 0 || paths[0] != "/json/01001000") {
+			t.Errorf("PAD_CEP=%v GET %s: upstream calls %v, want awesomeapi asked for 01001000", tt.pad, tt.target, paths)
+		}
+	}
+}
+
+func TestWeatherApiPartialResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		coverage bool
+		wantErr  error
+		wantWarn bool
+	}{
+		{
+			name:     "no current_units",
+			body:     `{"current":{"time":"2024-05-01T12:00","interval":900,"temperature_2m":21.4}}`,
+			wantWarn: true,
+		},
+		{
+			name:    "no current",
+			body:    `{"current_units":{"time":"iso8601","temperature_2m":"°C"}}`,
+			wantErr: errNoCurrentConditions,
+		},
+		{
+			name:    "empty current",
+			body:    `{"current_units":{"time":"iso8601","temperature_2m":"°C"},"current":{}}`,
+			wantErr: errNoCurrentConditions,
+		},
+		{
+			name:    "current without time",
+			body:    `{"current_units":{"time":"iso8601","temperature_2m":"°C"},"current":{"interval":900,"temperature_2m":21.4}}`,
+			wantErr: errNoCurrentConditions,
+		},
+		{
+			name:     "no current with WEATHER_COVERAGE_CHECK",
+			body:     `{}`,
+			coverage: true,
+			wantErr:  errNoWeatherCoverage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(upstream.Close)
+			setForTest(t, &openMeteoBaseURL, upstream.URL)
+			setForTest(t, &weatherCoverageCheck, tt.coverage)
+			var logs bytes.Buffer
+			ctx := context.WithValue(context.Background(), loggerCtxKey{}, slog.New(slog.NewTextHandler(&logs, nil)))
+
+			got, err := WeatherApi(ctx, "-23.5502784", "-46.6342179", "")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WeatherApi: %s", err)
+			}
+			if got.Current.Temperature2M != 21.4 {
+				t.Errorf("current = %+v", got.Current)
+			}
+			if warned := strings.Contains(logs.String(), "no current_units"); warned != tt.wantWarn {
+				t.Errorf("logged %q, want a current_units warning: %v", logs.String(), tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestCepAwesomeapiArrayResponse(t *testing.T) {
+	newFixtureServer(t, "multiple")
+
+	got, err := CepAwesomeapi(context.Background(), "78175000")
+	if err != nil {
+		t.Fatalf("CepAwesomeapi: %s", err)
+	}
+	// The record with coordinates is the primary one, whatever its position.
+	if got.City != "Poconé" || got.District != "Centro" || got.Latitude != "-16.2566" {
+		t.Errorf("got %+v, want the record with coordinates", got)
+	}
+	if len(got.Alternates) != 1 || got.Alternates[0].Latitude != "" {
+		t.Errorf("alternates = %+v, want the record without coordinates", got.Alternates)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/{cep}/address", HandlerAddress)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/78175000/address", nil))
+	var address Address
+	if err := json.Unmarshal(rec.Body.Bytes(), &address); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /78175000/address: %d %s", rec.Code, rec.Body)
+	}
+	if address.District != "Centro" || len(address.Alternates) != 1 || address.Alternates[0].City != "Poconé" {
+		t.Errorf("address = %+v", address)
+	}
+
+	if rec := serveCep(t, "/78175000"); rec.Code != http.StatusOK {
+		t.Errorf("GET /78175000: status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCepAwesomeapiEmptyArrayIsNotFound(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(upstream.Close)
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+
+	if _, err := CepAwesomeapi(context.Background(), "78175000"); !errors.Is(err, errCepNotFound) {
+		t.Errorf("err = %v, want %v", err, errCepNotFound)
+	}
+}
+
+func TestHandlerCepResponseEnvelope(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Get("/{cep}", HandlerCep)
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/01001000", nil)
+		req.Header.Set(middleware.RequestIDHeader, "req-123")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("off", func(t *testing.T) {
+		newFixtureServer(t, "success")
+		setForTest(t, &responseEnvelope, false)
+
+		var got map[string]any
+		if err := json.Unmarshal(get().Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["city"] != "São Paulo" || got["data"] != nil || got["meta"] != nil {
+			t.Errorf("body = %v, want the bare temperature", got)
+		}
+	})
+
+	t.Run("on", func(t *testing.T) {
+		newFixtureServer(t, "success")
+		setForTest(t, &responseEnvelope, true)
+
+		for _, wantSource := range []dataSource{sourceUpstream, sourceCache} {
+			rec := get()
+			var got struct {
+				Data Temperature
+				Meta struct {
+					RequestID string `json:"request_id"`
+					Timestamp string
+					Source    dataSource
+				}
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding %s: %s", rec.Body, err)
+			}
+			if got.Data.City != "São Paulo" || got.Data.TempC != 21.4 {
+				t.Errorf("data = %+v", got.Data)
+			}
+			if got.Meta.RequestID != "req-123" || got.Meta.Timestamp == "" || got.Meta.Source != wantSource {
+				t.Errorf("meta = %+v, want request_id req-123, a timestamp and source %q", got.Meta, wantSource)
+			}
+		}
+	})
+}
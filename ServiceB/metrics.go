@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds everything served on /metrics. It is the service's own registry
+// rather than the global default, so nothing a dependency registers globally ends up served.
+// The collectors below are package variables registered on it once, at init; a test reads
+// one back through the collector itself (prometheus/testutil) or by scraping metricsHandler,
+// not from a registry of its own.
+var (
+	metricsRegistry = newMetricsRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+)
+
+// newMetricsRegistry returns a registry with the Go runtime and process collectors the
+// default registry used to provide.
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newBreakerCollector(),
+	)
+	return reg
+}
+
+// metricsHandler serves reg in the Prometheus exposition format.
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+}
+
+// labelOther replaces any label value missing from metricLabelValues.
+const labelOther = "other"
+
+// metricLabelValues allowlists what each metric label may hold. Values reach labels from
+// configuration and, indirectly, from upstream data, and every distinct value is a new series
+// Prometheus keeps in memory; anything unexpected is bucketed as "other" instead.
+var metricLabelValues = map[string]map[string]bool{
+	"provider":    setOf("awesomeapi", "viacep", "openmeteo", "openmeteo-geocoding", "openmeteo-archive", "openweathermap", "nominatim", "ibge"),
+	"cache":       setOf("cep", "cep_location", "geocode", "geocode_negative", "weather"),
+	"served_from": setOf(string(sourceNone), string(sourceCache), string(sourceUpstream), string(sourceStale)),
+	"status":      httpStatuses(),
+}
+
+func setOf(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// httpStatuses is every status code net/http has a name for.
+func httpStatuses() map[string]bool {
+	set := make(map[string]bool)
+	for code := 100; code < 600; code++ {
+		if http.StatusText(code) != "" {
+			set[strconv.Itoa(code)] = true
+		}
+	}
+	return set
+}
+
+// labelValue returns value if label allows it and "other" otherwise. Every label value that
+// isn't a literal at the call site goes through it.
+func labelValue(label, value string) string {
+	if metricLabelValues[label][value] {
+		return value
+	}
+	return labelOther
+}
+
+var cacheLookups = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_lookups_total",
+	Help: "Cache lookups by cache and result (hit, negative_hit, miss, stale_hit).",
+}, []string{"cache", "result"})
+
+var redisErrors = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "redis_errors_total",
+	Help: "Redis cache errors by cache and operation (get, set, encode, decode). Each one was served without the cache.",
+}, []string{"cache", "op"})
+
+// upstreamResponseBytes is sized against MAX_UPSTREAM_BODY_BYTES: a body over the limit is
+// recorded as limit+1 bytes, since reading stops there.
+var upstreamResponseBytes = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "upstream_response_size_bytes",
+	Help:    "Size of upstream response bodies by provider.",
+	Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+}, []string{"provider"})
+
+// upstreamRequestDuration has one sample per attempt, retries included, covering the request
+// and the body read but not the wait for an UPSTREAM_MAX_CONCURRENCY slot; see latencyTransport.
+var upstreamRequestDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "upstream_request_duration_seconds",
+	Help:    "Latency of each upstream call attempt by provider and outcome (ok, error or timeout).",
+	Buckets: prometheus.DefBuckets,
+}, []string{"provider", "outcome"})
+
+var upstreamTimeoutSeconds = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upstream_timeout_seconds",
+	Help: "Per-call timeout currently applied to each CEP and weather provider (adaptive when ADAPTIVE_TIMEOUT is on).",
+}, []string{"provider"})
+
+// breakerCollector reads the live breakers on every scrape, so the gauge never lags behind a
+// state change. The value is the breakerState: 0 closed, 1 half-open, 2 open.
+type breakerCollector struct {
+	state *prometheus.Desc
+}
+
+func newBreakerCollector() breakerCollector {
+	return breakerCollector{state: prometheus.NewDesc(
+		"circuit_breaker_state",
+		"Circuit breaker state per provider chain and provider (0 closed, 1 half-open, 2 open).",
+		[]string{"chain", "provider"}, nil,
+	)}
+}
+
+func (c breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+}
+
+func (c breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, provider := range cepProviders {
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, float64(provider.breaker.State()), "cep", labelValue("provider", provider.Name()))
+	}
+	for _, provider := range weatherProviders {
+		ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, float64(provider.breaker.State()), "weather", labelValue("provider", provider.Name()))
+	}
+}
+
+var upstreamQueueWaiting = metricsFactory.NewGauge(prometheus.GaugeOpts{
+	Name: "upstream_queue_waiting",
+	Help: "Upstream calls waiting for a slot under UPSTREAM_MAX_CONCURRENCY.",
+})
+
+var telemetryErrors = metricsFactory.NewCounter(prometheus.CounterOpts{
+	Name: "otel_errors_total",
+	Help: "OpenTelemetry errors, mostly failed span exports. A rising rate means traces are being lost.",
+})
+
+var (
+	requestsInFlight = metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests currently being served, as seen by the load shedder.",
+	}, func() float64 { return float64(inFlightRequests.Load()) })
+
+	requestsShed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "http_requests_shed_total",
+		Help: "Requests rejected with 503 because the service was over its in-flight limit.",
+	})
+
+	cepRateLimited = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "cep_rate_limited_total",
+		Help: "CEP lookups refused an upstream call because the CEP was over CEP_RATE_LIMIT.",
+	})
+)
+
+var cepRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+	Name: "cep_requests_total",
+	Help: "Weather-by-CEP requests by response status and where the CEP data was served from (cache, upstream, none).",
+}, []string{"status", "served_from"})
+
+func recordCepRequest(status int, source dataSource) {
+	cepRequests.WithLabelValues(labelValue("status", strconv.Itoa(status)), labelValue("served_from", string(source))).Inc()
+}
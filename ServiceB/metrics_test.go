@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordCepRequestIsServedOnMetrics(t *testing.T) {
+	counter := cepRequests.WithLabelValues("200", string(sourceCache))
+	before := testutil.ToFloat64(counter)
+	recordCepRequest(http.StatusOK, sourceCache)
+	if got := testutil.ToFloat64(counter); got != before+1 {
+		t.Errorf("cep_requests_total = %v, want %v", got, before+1)
+	}
+
+	// A status net/http has no name for is bucketed rather than becoming a series of its own.
+	recordCepRequest(299, sourceCache)
+	if got := testutil.ToFloat64(cepRequests.WithLabelValues(labelOther, string(sourceCache))); got < 1 {
+		t.Errorf("cep_requests_total{status=%q} = %v, want at least 1", labelOther, got)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(metricsRegistry).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{`cep_requests_total{served_from="cache",status="200"}`, "circuit_breaker_state", "go_goroutines"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics is missing %s", want)
+		}
+	}
+}
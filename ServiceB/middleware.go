@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const requestTimeoutHeader = "X-Request-Timeout"
+
+type requestTimeoutKey struct{}
+
+// RequestTimeout works like middleware.Timeout, but a caller may ask for a different deadline
+// through the X-Request-Timeout header (e.g. "90s"). The override is clamped to max; malformed
+// or non-positive values are ignored and the fallback is used. An override longer than the
+// fallback also lifts the per-call upstream limits, through upstreamBudget.
+func RequestTimeout(fallback, max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := fallback
+			if override, err := time.ParseDuration(r.Header.Get(requestTimeoutHeader)); err == nil && override > 0 {
+				timeout = min(override, max)
+			}
+			if timeout > fallback {
+				r = r.WithContext(context.WithValue(r.Context(), requestTimeoutKey{}, timeout))
+			}
+			middleware.Timeout(timeout)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// StrictQuery answers 422 unknown_query_params when the request carries a query parameter
+// that isn't in allowed, naming every unknown one, so a client typo such as ?inlcude= fails
+// loudly instead of being ignored.
+func StrictQuery(allowed ...string) func(http.Handler) http.Handler {
+	known := setOf(allowed...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var unknown []string
+			for name := range r.URL.Query() {
+				if !known[name] {
+					unknown = append(unknown, name)
+				}
+			}
+			if len(unknown) > 0 {
+				slices.Sort(unknown)
+				writeError(w, r, http.StatusUnprocessableEntity, codeUnknownQuery, strings.Join(unknown, ", "))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// queryParams limits a route to the query parameters it reads, plus those every route takes,
+// when STRICT_QUERY_PARAMS is on. Off, unknown parameters are ignored as they always were.
+func queryParams(params ...string) func(http.Handler) http.Handler {
+	if !strictQueryParams {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	params = append(params, "pretty")
+	if debugEndpoints {
+		params = append(params, "delay")
+	}
+	return StrictQuery(params...)
+}
+
+// InjectDelay holds a request for ?delay= (a Go duration, at most max) before handling it, to
+// simulate a slow ServiceB in load tests. The wait ends early when the request's context does,
+// leaving the reply to the timeout middleware.
+func InjectDelay(max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw := r.URL.Query().Get("delay")
+			if raw == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			delay, err := time.ParseDuration(raw)
+			if err != nil || delay < 0 {
+				writeError(w, r, http.StatusUnprocessableEntity, codeInvalidDelay, max)
+				return
+			}
+
+			timer := time.NewTimer(min(delay, max))
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				next.ServeHTTP(w, r)
+			case <-r.Context().Done():
+			}
+		})
+	}
+}
+
+// upstreamBudget is how long one upstream call made for the request in ctx may take: limit, or
+// the longer timeout its caller asked for with X-Request-Timeout, so a slow job that was given
+// 90s isn't cut off by a 10s per-call limit. The request's own deadline applies either way.
+func upstreamBudget(ctx context.Context, limit time.Duration) time.Duration {
+	if requested, ok := ctx.Value(requestTimeoutKey{}).(time.Duration); ok {
+		return max(requested, limit)
+	}
+	return limit
+}
+
+// RequireToken rejects requests that don't carry token, either as "Authorization: Bearer <token>"
+// or as the basic-auth password (any username). An empty token disables the check.
+func RequireToken(token, realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				_, credential, _ = r.BasicAuth()
+			}
+			if subtle.ConstantTimeCompare([]byte(credential), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+				writeError(w, r, http.StatusUnauthorized, codeUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StaticHeaders sets headers on every response before the handler runs, so errors and
+// rejected requests carry them too.
+func StaticHeaders(headers http.Header) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range headers {
+				w.Header()[name] = values
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CanonicalCepRedirect answers 301 with the canonical path when the {cep} in the URL is a
+// valid CEP written another way (01001-000, or 1001000 with PAD_CEP), so caches in front of
+// the service key each CEP once. Anything that doesn't normalize to a valid CEP goes on to
+// the handler to be rejected there.
+func CanonicalCepRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := chi.URLParam(r, "cep")
+		cep, err := parseCep(raw)
+		if err != nil || cep == raw {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := *r.URL
+		rest := strings.TrimPrefix(r.URL.Path, "/"+raw)
+		target.Path = "/" + cep + rest
+		target.RawPath = "/" + url.PathEscape(cep) + rest
+		http.Redirect(w, r, target.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// RejectWhenShuttingDown answers new requests with 503 and Connection: close once shutdown has
+// begun, while requests already past it run to completion. Paths in exempt are still served.
+func RejectWhenShuttingDown(exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if shuttingDown.Load() && !slices.Contains(exempt, r.URL.Path) {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusServiceUnavailable, codeShuttingDown)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var inFlightRequests atomic.Int64
+
+// LoadShedder rejects requests with 503 once highWater requests are already in flight, so an
+// overloaded instance fails fast instead of piling up work it can't finish in time. Paths in
+// exempt (metrics, health checks) are never shed.
+func LoadShedder(highWater int64, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			defer inFlightRequests.Add(-1)
+			if inFlightRequests.Add(1) > highWater {
+				requestsShed.Inc()
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, codeOverloaded)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
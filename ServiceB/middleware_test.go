@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRequestTimeoutOverrideOutlastsUpstreamTimeouts(t *testing.T) {
+	for _, p := range []*time.Duration{&upstreamTimeout, &cepAPITimeout, &weatherAPITimeout, &responseHeaderTimeout} {
+		setForTest(t, p, 50*time.Millisecond)
+	}
+	setForTest(t, &upstreamClient, newUpstreamClient())
+
+	// Both upstreams answer the recorded success fixtures, but slower than any per-call limit.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		fixture := "testdata/fixtures/success/openmeteo.json"
+		if strings.HasPrefix(r.URL.Path, "/json/") {
+			fixture = "testdata/fixtures/success/awesomeapi.json"
+		}
+		body, _ := os.ReadFile(fixture)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	router := chi.NewRouter()
+	router.Use(RequestTimeout(time.Second, 5*time.Second))
+	router.Get("/{cep}", HandlerCep)
+	get := func(timeout string) *httptest.ResponseRecorder {
+		isolateUpstreams(t)
+		setForTest(t, &awesomeapiBaseURL, upstream.URL)
+		setForTest(t, &openMeteoBaseURL, upstream.URL)
+		req := httptest.NewRequest(http.MethodGet, "/01001000", nil)
+		if timeout != "" {
+			req.Header.Set(requestTimeoutHeader, timeout)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(""); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("without an override, status = %d, want 504: %s", rec.Code, rec.Body)
+	}
+	if rec := get("3s"); rec.Code != http.StatusOK {
+		t.Errorf("with X-Request-Timeout: 3s, status = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestUpstreamBudget(t *testing.T) {
+	var got time.Duration
+	handler := RequestTimeout(time.Second, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = upstreamBudget(r.Context(), 10*time.Second)
+	}))
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: 10 * time.Second},
+		// A shorter deadline, such as the budget ServiceA forwards, leaves the limit alone.
+		{header: "500ms", want: 10 * time.Second},
+		{header: "5s", want: 10 * time.Second},
+		{header: "30s", want: 30 * time.Second},
+		{header: "1h", want: time.Minute},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(requestTimeoutHeader, tt.header)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("X-Request-Timeout %q: budget %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestQueryParamsStrictAndLenient(t *testing.T) {
+	tests := []struct {
+		strict     bool
+		debug      bool
+		target     string
+		wantStatus int
+		wantDetail string
+	}{
+		{strict: false, target: "/01001000?inlcude=forecast&units=k", wantStatus: http.StatusOK},
+		{strict: true, target: "/01001000?include=forecast&pretty=true", wantStatus: http.StatusOK},
+		{strict: true, target: "/01001000", wantStatus: http.StatusOK},
+		{strict: true, target: "/01001000?units=k&inlcude=forecast", wantStatus: http.StatusUnprocessableEntity, wantDetail: "inlcude, units"},
+		{strict: true, target: "/01001000?delay=1s", wantStatus: http.StatusUnprocessableEntity, wantDetail: "delay"},
+		{strict: true, debug: true, target: "/01001000?delay=1s", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		setForTest(t, &strictQueryParams, tt.strict)
+		setForTest(t, &debugEndpoints, tt.debug)
+		router := chi.NewRouter()
+		router.With(queryParams("include")).Get("/{cep}", func(w http.ResponseWriter, r *http.Request) {})
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("STRICT_QUERY_PARAMS=%v GET %s: status = %d, want %d: %s", tt.strict, tt.target, rec.Code, tt.wantStatus, rec.Body)
+			continue
+		}
+		if tt.wantDetail == "" {
+			continue
+		}
+		var body ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if body.Code != codeUnknownQuery || !strings.HasSuffix(body.Error, tt.wantDetail) {
+			t.Errorf("GET %s: body = %s, want %q naming %s", tt.target, rec.Body, codeUnknownQuery, tt.wantDetail)
+		}
+	}
+}
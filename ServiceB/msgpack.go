@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// marshalMsgpack encodes v as MessagePack following the encoding/json rules the responses are
+// written for: json tags name fields and honor omitempty and "-", embedded structs are
+// flattened, map keys are sorted, and a type with its own MarshalJSON (time.Time, jsonTime)
+// is encoded as whatever that JSON decodes to. It covers the types the handlers return, not
+// all of the format: there are no extension types and floats are always written as float64.
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	jsonNumberType    = reflect.TypeFor[json.Number]()
+)
+
+func encodeMsgpack(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || reflect.PointerTo(v.Type()).Implements(jsonMarshalerType) && v.CanAddr() {
+		return encodeMsgpackViaJSON(buf, v)
+	}
+	// A json.Number is a string to reflect but a number in the JSON it stands for, wherever it
+	// turns up: a struct field, or deep inside what encodeMsgpackViaJSON decoded.
+	if v.Type() == jsonNumberType {
+		return encodeMsgpackNumber(buf, json.Number(v.String()))
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMsgpack(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		buf.WriteByte(0xcb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())))
+	case reflect.String:
+		writeMsgpackString(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeMsgpackHeader(buf, v.Len(), 0, 0xc4, 0xc5, 0xc6)
+			buf.Write(v.Bytes())
+			return nil
+		}
+		writeMsgpackHeader(buf, v.Len(), 0x90, 0, 0xdc, 0xdd)
+		for i := range v.Len() {
+			if err := encodeMsgpack(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return encodeMsgpackMap(buf, v)
+	case reflect.Struct:
+		return encodeMsgpackStruct(buf, v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func encodeMsgpackViaJSON(buf *bytes.Buffer, v reflect.Value) error {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return err
+	}
+	return encodeMsgpack(buf, reflect.ValueOf(generic))
+}
+
+// encodeMsgpackNumber writes n as an integer when it is one and as a float64 otherwise. An
+// empty n is 0, as encoding/json writes it.
+func encodeMsgpackNumber(buf *bytes.Buffer, n json.Number) error {
+	if n == "" {
+		n = "0"
+	}
+	if i, err := n.Int64(); err == nil {
+		writeMsgpackInt(buf, i)
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	return encodeMsgpack(buf, reflect.ValueOf(f))
+}
+
+func encodeMsgpackMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.IsNil() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	for iter := v.MapRange(); iter.Next(); {
+		key := fmt.Sprint(iter.Key().Interface())
+		if tm, ok := iter.Key().Interface().(encoding.TextMarshaler); ok {
+			text, err := tm.MarshalText()
+			if err != nil {
+				return err
+			}
+			key = string(text)
+		}
+		keys = append(keys, key)
+		values[key] = iter.Value()
+	}
+	slices.Sort(keys)
+
+	writeMsgpackHeader(buf, len(keys), 0x80, 0, 0xde, 0xdf)
+	for _, key := range keys {
+		writeMsgpackString(buf, key)
+		if err := encodeMsgpack(buf, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type msgpackField struct {
+	name  string
+	value reflect.Value
+}
+
+func encodeMsgpackStruct(buf *bytes.Buffer, v reflect.Value) error {
+	fields := msgpackFields(v)
+	writeMsgpackHeader(buf, len(fields), 0x80, 0, 0xde, 0xdf)
+	for _, f := range fields {
+		writeMsgpackString(buf, f.name)
+		if err := encodeMsgpack(buf, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackFields lists the fields encoding/json would write for v, in declaration order.
+func msgpackFields(v reflect.Value) []msgpackField {
+	var fields []msgpackField
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+
+		if sf.Anonymous && name == "" {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				fields = append(fields, msgpackFields(fv)...)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, msgpackField{name: name, value: fv})
+	}
+	return fields
+}
+
+// isEmptyValue is encoding/json's notion of empty for omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	default:
+		buf.WriteByte(0xd3)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u < 128:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(u)})
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(u)))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(u)))
+	default:
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, u))
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	if len(s) < 32 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		writeMsgpackHeader(buf, len(s), 0, 0xd9, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+// writeMsgpackHeader writes the length prefix of a string, binary, array or map. fixBase is
+// the one-byte form for lengths under 16 and code8 the 8-bit form, each 0 when the type has
+// none; code16 and code32 are the 16- and 32-bit forms.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fixBase, code8, code16, code32 byte) {
+	switch {
+	case fixBase != 0 && n < 16:
+		buf.WriteByte(fixBase | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{code8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(code32)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianodevfullstack/lab02.git/temperature"
+)
+
+// decodeMsgpack is a reference decoder for the subset of MessagePack marshalMsgpack writes,
+// following the spec rather than the encoder. Maps decode to map[string]any, arrays to []any,
+// every integer to int64 (or uint64 past MaxInt64) and every float to float64.
+func decodeMsgpack(data []byte) (any, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.value()
+	if err == nil && d.pos != len(data) {
+		err = fmt.Errorf("%d trailing bytes", len(data)-d.pos)
+	}
+	return v, err
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) {
+		return nil, fmt.Errorf("truncated at byte %d", d.pos)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads an n-byte big-endian length.
+func (d *msgpackDecoder) length(n int) (int, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var l uint64
+	for _, c := range b {
+		l = l<<8 | uint64(c)
+	}
+	return int(l), nil
+}
+
+func (d *msgpackDecoder) value() (any, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(n)
+		return bytes.Clone(b), err
+	case 0xca:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var u uint64
+		for _, x := range b {
+			u = u<<8 | uint64(x)
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := d.next(1 << (c - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		switch len(b) {
+		case 1:
+			return int64(int8(b[0])), nil
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		}
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(n)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(n)
+	}
+	return nil, fmt.Errorf("unsupported type byte %#x at %d", c, d.pos-1)
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) arrayOf(n int) ([]any, error) {
+	a := make([]any, n)
+	for i := range a {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (map[string]any, error) {
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key %v is not a string", k)
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// viaJSON is what a JSON client would read for v, with every number as a float64 so it
+// compares equal to the decoded MessagePack whichever of int or float the encoder chose.
+func viaJSON(t *testing.T, v any) any {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	return generic
+}
+
+// numbersAsFloat converts every integer in a decoded value to float64, as viaJSON does.
+func numbersAsFloat(v any) any {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case []any:
+		for i := range v {
+			v[i] = numbersAsFloat(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = numbersAsFloat(v[k])
+		}
+	}
+	return v
+}
+
+func TestMarshalMsgpackKnownEncodings(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{in: nil, want: "c0"},
+		{in: true, want: "c3"},
+		{in: 0, want: "00"},
+		{in: 127, want: "7f"},
+		{in: 128, want: "cc80"},
+		{in: 65536, want: "ce00010000"},
+		{in: -1, want: "ff"},
+		{in: -33, want: "d0df"},
+		{in: -129, want: "d1ff7f"},
+		{in: 1.5, want: "cb3ff8000000000000"},
+		{in: "a", want: "a161"},
+		{in: strings.Repeat("x", 32), want: "d920" + strings.Repeat("78", 32)},
+		{in: []int{1, 2}, want: "920102"},
+		{in: map[string]int{"b": 2, "a": 1}, want: "82a16101a16202"},
+		{in: json.Number("42"), want: "2a"},
+		{in: json.Number("-2.5"), want: "cbc004000000000000"},
+	}
+	for _, tt := range tests {
+		got, err := marshalMsgpack(tt.in)
+		if err != nil {
+			t.Errorf("marshalMsgpack(%#v): %s", tt.in, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("marshalMsgpack(%#v) = %x, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// numberHolder marshals through encodeMsgpackViaJSON, so its numbers come back from the JSON
+// decoder as json.Number, nested inside maps and arrays.
+type numberHolder struct{ raw string }
+
+func (h numberHolder) MarshalJSON() ([]byte, error) { return []byte(h.raw), nil }
+
+func TestMarshalMsgpackRoundTrip(t *testing.T) {
+	sunrise := jsonTime(time.Date(2026, 10, 15, 5, 42, 0, 0, time.UTC))
+	type embedded struct {
+		Source string `json:"source"`
+	}
+	type response struct {
+		embedded
+		City        string                   `json:"city"`
+		Temperature temperature.Temperature  `json:"temperature"`
+		FeelsLike   *temperature.Temperature `json:"feels_like,omitempty"`
+		Sunrise     *jsonTime                `json:"sunrise,omitempty"`
+		Hidden      string                   `json:"-"`
+		Count       json.Number              `json:"count"`
+		Tags        []string                 `json:"tags"`
+		Extra       map[string]any           `json:"extra,omitempty"`
+	}
+
+	tests := map[string]any{
+		"weather response": response{
+			embedded:    embedded{Source: "upstream"},
+			City:        "São Paulo",
+			Temperature: temperature.FromCelsius(21.4),
+			Sunrise:     &sunrise,
+			Hidden:      "never encoded",
+			Count:       json.Number("3"),
+			Tags:        []string{strings.Repeat("long tag ", 5)},
+			Extra:       map[string]any{"ddd": 11, "approximate": false, "nil": nil},
+		},
+		"omitempty and nil slice": response{City: "x"},
+		"nested json.Number":      numberHolder{raw: `{"n":7,"f":-0.25,"big":12345678901,"list":[1,2.5,{"deep":-40}]}`},
+		"every length class": map[string]any{
+			"str8":    strings.Repeat("s", 200),
+			"str16":   strings.Repeat("s", 70000),
+			"array16": make([]int, 20),
+		},
+	}
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := marshalMsgpack(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeMsgpack(data)
+			if err != nil {
+				t.Fatalf("decoding %x: %s", data, err)
+			}
+			if want := viaJSON(t, in); !reflect.DeepEqual(numbersAsFloat(got), want) {
+				t.Errorf("round trip = %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalMsgpackNestedJSONNumberTypes(t *testing.T) {
+	data, err := marshalMsgpack(numberHolder{raw: `{"n":7,"f":-0.25,"list":[-40]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeMsgpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"n": int64(7), "f": -0.25, "list": []any{int64(-40)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// weatherPrefetcher warms weatherCache in the background for CEPs whose address was just
+// served from the cache, so a weather request that follows doesn't wait on the upstream. At
+// most concurrency prefetches run at once; beyond that they are dropped, not queued.
+type weatherPrefetcher struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	sem  chan struct{}
+
+	// mu orders Prefetch's wg.Go against Stop's wg.Wait: once stopped is set, nothing is added.
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newWeatherPrefetcher(concurrency int) *weatherPrefetcher {
+	ctx, stop := context.WithCancel(context.Background())
+	return &weatherPrefetcher{ctx: ctx, stop: stop, sem: make(chan struct{}, concurrency)}
+}
+
+var prefetcher = newWeatherPrefetcher(weatherPrefetchConcurrency)
+
+// Prefetch starts fetching the current weather for cep unless the prefetcher is full or
+// stopped. The prefetch gets its own trace, linked to the request in ctx.
+func (p *weatherPrefetcher) Prefetch(ctx context.Context, cep *CepAwesomeapiResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		return
+	}
+	link := trace.LinkFromContext(ctx)
+	p.wg.Go(func() {
+		defer func() { <-p.sem }()
+
+		tracer := otel.Tracer("microservice-tracer")
+		ctx, span := tracer.Start(p.ctx, "PrefetchWeather", trace.WithNewRoot(), trace.WithLinks(link))
+		defer span.End()
+		ctx, cancel := context.WithTimeout(ctx, weatherAPITimeout)
+		defer cancel()
+
+		latitude, longitude, _, err := weatherCoordinates(ctx, cep)
+		if err == nil {
+			_, _, _, err = LookupWeather(ctx, latitude, longitude, "")
+		}
+		if err != nil {
+			logFromCtx(ctx).Debug("weather prefetch failed", slog.String("cep", cep.Cep), slog.String("error", err.Error()))
+		}
+	})
+}
+
+// Stop cancels the prefetches in flight, refuses new ones and waits for them to return.
+func (p *weatherPrefetcher) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.stop()
+	p.wg.Wait()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestPrefetchWarmsWeatherCache(t *testing.T) {
+	upstream := newFixtureServer(t, "success")
+	p := newWeatherPrefetcher(2)
+	cep := &CepAwesomeapiResponse{Cep: "01001000", City: "São Paulo", State: "SP", Latitude: "-23.55", Longitude: "-46.63"}
+
+	p.Prefetch(context.Background(), cep)
+	p.wg.Wait()
+	p.Stop()
+	if calls := upstream.Calls("/v1/forecast"); calls != 1 {
+		t.Fatalf("prefetch made %d weather calls, want 1", calls)
+	}
+	if _, _, _, err := LookupWeather(context.Background(), cep.Latitude, cep.Longitude, ""); err != nil {
+		t.Fatal(err)
+	}
+	if calls := upstream.Calls("/v1/forecast"); calls != 1 {
+		t.Errorf("weather lookup after the prefetch went upstream again (%d calls)", calls)
+	}
+}
+
+func TestPrefetchAfterStopIsDropped(t *testing.T) {
+	upstream := newFixtureServer(t, "success")
+	p := newWeatherPrefetcher(2)
+	p.Stop()
+	p.Prefetch(context.Background(), &CepAwesomeapiResponse{Cep: "01001000", Latitude: "-23.55", Longitude: "-46.63"})
+	p.wg.Wait()
+	if calls := upstream.Calls("/v1/forecast"); calls != 0 {
+		t.Errorf("a stopped prefetcher made %d weather calls", calls)
+	}
+}
+
+// TestPrefetchRacingStop is for go test -race: prefetches started while Stop runs must either
+// be dropped or be waited for, never added to the WaitGroup after Stop's Wait began.
+func TestPrefetchRacingStop(t *testing.T) {
+	newFixtureServer(t, "success")
+	for range 20 {
+		p := newWeatherPrefetcher(4)
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				p.Prefetch(context.Background(), &CepAwesomeapiResponse{Cep: "01001000", Latitude: "-23.55", Longitude: "-46.63"})
+			})
+		}
+		p.Stop()
+		wg.Wait()
+	}
+}
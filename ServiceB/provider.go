@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errCepNotFound         = errors.New("cep not found")
+	errNoProviderAvailable = errors.New("no cep provider available")
+)
+
+// CepProvider resolves a CEP to an address with coordinates. Implementations return
+// errCepNotFound when the provider answered but doesn't know the CEP, and a *geocodeError
+// when it answered but its city couldn't be geocoded; any other error counts as a provider
+// failure.
+type CepProvider interface {
+	Name() string
+	Lookup(ctx context.Context, cep string) (*CepAwesomeapiResponse, error)
+}
+
+// geocodeError is a failure of the geocoder a provider relies on for coordinates, not of the
+// provider itself, so it is kept off the provider's breaker.
+type geocodeError struct {
+	City, State string
+	Err         error
+}
+
+func (e *geocodeError) Error() string {
+	return fmt.Sprintf("geocoding %s/%s: %s", e.City, e.State, e.Err)
+}
+
+func (e *geocodeError) Unwrap() error {
+	return e.Err
+}
+
+type awesomeapiProvider struct{}
+
+func (awesomeapiProvider) Name() string { return "awesomeapi" }
+
+func (awesomeapiProvider) Lookup(ctx context.Context, cep string) (*CepAwesomeapiResponse, error) {
+	return CepAwesomeapi(ctx, cep)
+}
+
+type viacepProvider struct{}
+
+func (viacepProvider) Name() string { return "viacep" }
+
+func (viacepProvider) Lookup(ctx context.Context, cep string) (*CepAwesomeapiResponse, error) {
+	return ViacepApi(ctx, cep)
+}
+
+var knownCepProviders = map[string]CepProvider{
+	"awesomeapi": awesomeapiProvider{},
+	"viacep":     viacepProvider{},
+}
+
+// dataSource says where the data behind a response came from.
+type dataSource string
+
+const (
+	sourceNone     dataSource = "none"
+	sourceCache    dataSource = "cache"
+	sourceUpstream dataSource = "upstream"
+	// sourceStale is an expired cache entry served because every provider failed.
+	sourceStale dataSource = "stale"
+)
+
+type guardedCepProvider struct {
+	CepProvider
+	breaker *circuitBreaker
+	timeout *adaptiveTimeout
+}
+
+var (
+	cepProviders = newCepProviders(envList("CEP_PROVIDERS", []string{"awesomeapi", "viacep"}))
+	cepCache     = newCache[CepAwesomeapiResponse]("cep")
+	// cepLocationCache is the second tier behind cepCache: only what a weather lookup needs,
+	// kept for CEP_LOCATION_CACHE_TTL.
+	cepLocationCache = newCache[CepLocation]("cep_location")
+
+	cepFlights cepFlightGroup
+	// cepRateLimiter caps provider walks per CEP; nil when CEP_RATE_LIMIT is unset.
+	cepRateLimiter = newCepRateLimiter()
+)
+
+func newCepRateLimiter() *cepCallLimiter {
+	if cepRateLimit <= 0 {
+		return nil
+	}
+	return newCepCallLimiter(cepRateLimit, cepRateLimitInterval)
+}
+
+// CepLocation is the long-lived part of an address that weather lookups use.
+type CepLocation struct {
+	Latitude  string `json:"lat"`
+	Longitude string `json:"lng"`
+	City      string `json:"city"`
+	State     string `json:"state"`
+	Ddd       string `json:"ddd"`
+}
+
+// newCepProviders builds the ordered provider chain, each with its own breaker. Unknown
+// names are logged and skipped.
+func newCepProviders(names []string) []guardedCepProvider {
+	var providers []guardedCepProvider
+	for _, name := range names {
+		provider, ok := knownCepProviders[name]
+		if !ok {
+			log.Printf("ignoring unknown cep provider %q", name)
+			continue
+		}
+		providers = append(providers, guardedCepProvider{
+			CepProvider: provider,
+			breaker:     newCircuitBreaker(breakerFailureThreshold, breakerCooldown),
+			timeout:     newAdaptiveTimeout(name, cepAPITimeout),
+		})
+	}
+	return providers
+}
+
+// LookupCep answers from cepCache when possible, including cached not-found results, and
+// otherwise walks the provider chain in order, once for all concurrent lookups of the CEP.
+// Providers whose breaker is open are skipped right away instead of waiting for them to time
+// out. A not-found answer is authoritative and stops the walk; failures move on to the next
+// provider. With CEP_RATE_LIMIT, a CEP that used up its walks for the interval fails with
+// errCepRateLimited instead. With SERVE_STALE, an address that expired from the cache less
+// than MAX_STALE_AGE ago is returned when every provider fails or the CEP is rate limited.
+func LookupCep(ctx context.Context, cep string) (*CepAwesomeapiResponse, dataSource, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "LookupCep")
+	defer span.End()
+
+	entry, ok := cacheGet(ctx, cepCache, "cep", cep)
+	traceCacheLookup(ctx, "cep", cep, ok, entry.Negative)
+	if ok {
+		span.SetAttributes(attribute.Bool("cache.hit", true), attribute.Bool("cache.negative", entry.Negative))
+		if entry.Negative {
+			return nil, sourceCache, errCepNotFound
+		}
+		return &entry.Value, sourceCache, nil
+	}
+
+	return cepFlights.Do(ctx, cep, func(ctx context.Context) (*CepAwesomeapiResponse, dataSource, error) {
+		return lookupCepUpstream(ctx, cep)
+	})
+}
+
+func lookupCepUpstream(ctx context.Context, cep string) (*CepAwesomeapiResponse, dataSource, error) {
+	span := trace.SpanFromContext(ctx)
+
+	lastErr := errNoProviderAvailable
+	providers := cepProviders
+	if cepRateLimiter != nil && !cepRateLimiter.Allow(cep) {
+		cepRateLimited.Inc()
+		span.AddEvent("rate_limited", trace.WithAttributes(stringAttr("cep", cep)))
+		lastErr, providers = errCepRateLimited, nil
+	}
+	for _, provider := range providers {
+		providerAttr := stringAttr("provider", provider.Name())
+		if !provider.breaker.Allow() {
+			span.AddEvent("skipped_open_breaker", trace.WithAttributes(providerAttr))
+			continue
+		}
+
+		var cepResponse *CepAwesomeapiResponse
+		err := provider.timeout.Do(ctx, func(ctx context.Context) (err error) {
+			cepResponse, err = provider.Lookup(ctx, cep)
+			return err
+		})
+		if err == nil {
+			provider.breaker.Success()
+			span.SetAttributes(stringAttr("cep.provider", provider.Name()), stringAttr("cep.city", cepResponse.City))
+			cepCache.Set(cep, *cepResponse, time.Duration(runtimeConfig.Load().CepCacheTTL))
+			cepLocationCache.Set(cep, CepLocation{
+				Latitude:  cepResponse.Latitude,
+				Longitude: cepResponse.Longitude,
+				City:      cepResponse.City,
+				State:     cepResponse.State,
+				Ddd:       cepResponse.Ddd,
+			}, cepLocationCacheTTL)
+			return cepResponse, sourceUpstream, nil
+		}
+		if errors.Is(err, errCepNotFound) {
+			provider.breaker.Success()
+			cepCache.SetNegative(cep, time.Duration(runtimeConfig.Load().NegativeCacheTTL))
+			return nil, sourceUpstream, err
+		}
+		// The provider answered; it is the geocoder behind it that failed, and the next
+		// provider may have coordinates of its own.
+		var geoErr *geocodeError
+		if errors.As(err, &geoErr) {
+			provider.breaker.Success()
+		} else {
+			provider.breaker.Failure()
+		}
+		span.AddEvent("provider_failed", trace.WithAttributes(providerAttr, stringAttr("error", err.Error())))
+		logFromCtx(ctx).Warn("provider failed, trying next", slog.String("provider", provider.Name()), slog.String("error", err.Error()))
+		lastErr = err
+	}
+
+	// A recently expired address beats an error, but only within MAX_STALE_AGE.
+	if serveStale && !errors.Is(lastErr, errCepNotFound) && !cacheBypassed(ctx, "cep", cep) {
+		if entry, ok := cepCache.GetStale(cep, maxStaleAge); ok {
+			span.AddEvent("cache.stale", trace.WithAttributes(stringAttr("cache.key", cep)))
+			logFromCtx(ctx).Warn("all providers failed, serving stale address", slog.String("cep", cep), slog.String("error", lastErr.Error()))
+			return &entry.Value, sourceStale, nil
+		}
+	}
+	return nil, sourceNone, lastErr
+}
+
+// LookupCepLocation resolves a CEP as far as a weather lookup needs: from cepLocationCache
+// when it has the CEP, even if its full address has expired, and through LookupCep otherwise.
+// A location hit is an address with only Cep, Latitude, Longitude, City, State and Ddd set.
+func LookupCepLocation(ctx context.Context, cep string) (*CepAwesomeapiResponse, dataSource, error) {
+	entry, ok := cacheGet(ctx, cepLocationCache, "cep_location", cep)
+	traceCacheLookup(ctx, "cep_location", cep, ok, false)
+	if !ok {
+		return LookupCep(ctx, cep)
+	}
+	return &CepAwesomeapiResponse{
+		Cep:       cep,
+		Latitude:  entry.Value.Latitude,
+		Longitude: entry.Value.Longitude,
+		City:      entry.Value.City,
+		State:     entry.Value.State,
+		Ddd:       entry.Value.Ddd,
+	}, sourceCache, nil
+}
+
+type ViacepResponse struct {
+	Cep        string `json:"cep"`
+	Logradouro string `json:"logradouro"`
+	Bairro     string `json:"bairro"`
+	Localidade string `json:"localidade"`
+	Uf         string `json:"uf"`
+	Estado     string `json:"estado"`
+	Ibge       string `json:"ibge"`
+	Ddd        string `json:"ddd"`
+}
+
+// ViacepApi looks the CEP up on ViaCEP. ViaCEP has no coordinates, so the city is geocoded
+// to fill them in.
+func ViacepApi(ctx context.Context, cep string) (*CepAwesomeapiResponse, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "ViacepApi")
+	defer span.End()
+
+	url := viacepBaseURL + "/ws/" + url.PathEscape(cep) + "/json/"
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "viacep"), "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("viacep", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("viacep", resp, body, fmt.Errorf("viacep api returned %d", resp.StatusCode))
+	}
+
+	var viacepResponse ViacepResponse
+	if err := decodeUpstreamJSON("viacep", resp, body, &viacepResponse); err != nil {
+		return nil, err
+	}
+
+	// Unknown CEPs come back as 200 with {"erro": true}.
+	if viacepResponse.Localidade == "" {
+		return nil, errCepNotFound
+	}
+
+	location, err := GeocodeCity(ctx, viacepResponse.Localidade, viacepResponse.Estado)
+	if err != nil {
+		return nil, &geocodeError{City: viacepResponse.Localidade, State: viacepResponse.Uf, Err: err}
+	}
+
+	return &CepAwesomeapiResponse{
+		Cep:       strings.ReplaceAll(viacepResponse.Cep, "-", ""),
+		Address:   viacepResponse.Logradouro,
+		State:     viacepResponse.Uf,
+		District:  viacepResponse.Bairro,
+		Latitude:  strconv.FormatFloat(location.Latitude, 'f', -1, 64),
+		Longitude: strconv.FormatFloat(location.Longitude, 'f', -1, 64),
+		City:      viacepResponse.Localidade,
+		Ibge:      viacepResponse.Ibge,
+		Ddd:       viacepResponse.Ddd,
+	}, nil
+}
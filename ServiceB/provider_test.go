@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGeocoderFailuresStayOffViacepBreaker(t *testing.T) {
+	for _, geocodeErr := range []error{errGeocoderBusy, errCityNotFound} {
+		t.Run(geocodeErr.Error(), func(t *testing.T) {
+			upstream := newFixtureServer(t, "success")
+			viacep := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"cep":"01001-000","logradouro":"Praça da Sé","localidade":"São Paulo","uf":"SP","estado":"São Paulo"}`)
+			}))
+			defer viacep.Close()
+			setForTest(t, &viacepBaseURL, viacep.URL)
+			setForTest(t, &geocoder, Geocoder(failingGeocoder{geocodeErr}))
+			setForTest(t, &cepProviders, newCepProviders([]string{"viacep", "awesomeapi"}))
+
+			for i := range breakerFailureThreshold + 1 {
+				cep := fmt.Sprintf("0100100%d", i)
+				_, err := ViacepApi(context.Background(), cep)
+				var geoErr *geocodeError
+				if !errors.As(err, &geoErr) || !errors.Is(err, geocodeErr) {
+					t.Fatalf("ViacepApi error = %v, want a geocodeError wrapping %v", err, geocodeErr)
+				}
+				// The walk moves on to awesomeapi, which has coordinates of its own.
+				if _, _, err := LookupCep(context.Background(), cep); err != nil {
+					t.Fatalf("LookupCep(%s): %s", cep, err)
+				}
+			}
+			if state := cepProviders[0].breaker.State(); state != breakerClosed {
+				t.Errorf("viacep breaker is %v after geocoder failures, want closed", state)
+			}
+			if calls := upstream.Calls("/json/"); calls != breakerFailureThreshold+1 {
+				t.Errorf("awesomeapi answered %d lookups, want %d", calls, breakerFailureThreshold+1)
+			}
+		})
+	}
+}
+
+func TestLookupCepServesStaleOnlyWithinMaxStaleAge(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiredAt time.Duration
+		wantStale bool
+	}{
+		{name: "recently expired", expiredAt: time.Minute, wantStale: true},
+		{name: "older than MAX_STALE_AGE", expiredAt: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newFixtureServer(t, "rate_limited")
+			setForTest(t, &serveStale, true)
+			setForTest(t, &maxStaleAge, time.Hour)
+			stale := newTTLCache[CepAwesomeapiResponse]("cep", 10)
+			stale.store("01001000", cacheEntry[CepAwesomeapiResponse]{
+				Value:     CepAwesomeapiResponse{Cep: "01001000", City: "São Paulo"},
+				ExpiresAt: time.Now().Add(-tt.expiredAt),
+			})
+			setForTest(t, &cepCache, cache[CepAwesomeapiResponse](stale))
+
+			got, source, err := LookupCep(context.Background(), "01001000")
+			if tt.wantStale {
+				if err != nil || source != sourceStale || got.City != "São Paulo" {
+					t.Errorf("LookupCep = %+v, %s, %v, want the stale entry", got, source, err)
+				}
+				return
+			}
+			var upErr *upstreamError
+			if !errors.As(err, &upErr) || source != sourceNone {
+				t.Errorf("LookupCep = %+v, %s, %v, want the upstream error", got, source, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRedisNil is returned for a nil bulk reply, i.e. GET on a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// redisError is an error reply (-ERR ..., -WRONGTYPE ...). The server answered in full, so the
+// connection is still in a known state.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient speaks just enough RESP for the cache: GET and SET with an expiry. Connections
+// are pooled; one that fails on I/O or with a reply we can't parse is discarded rather than
+// returned to the pool, while an error reply leaves it in the pool.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	timeout  time.Duration
+
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// newRedisClient parses a redis://[user:password@]host[:port][/db] URL. No connection is made
+// until the first command.
+func newRedisClient(rawURL string, timeout time.Duration, poolSize int) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme %q", u.Scheme)
+	}
+
+	client := &redisClient{
+		addr:    u.Host,
+		timeout: timeout,
+		pool:    make(chan *redisConn, poolSize),
+	}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.username = u.User.Username()
+		client.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return client, nil
+}
+
+// Get returns the value stored at key, or errRedisNil when there is none.
+func (c *redisClient) Get(key string) ([]byte, error) {
+	return c.do("GET", key)
+}
+
+// Set stores value at key with a millisecond-precision expiry. A ttl under a millisecond is
+// rounded up, since Redis rejects PX 0; one that has already run out stores nothing.
+func (c *redisClient) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	px := max(ttl.Milliseconds(), 1)
+	_, err := c.do("SET", key, string(value), "PX", strconv.FormatInt(px, 10))
+	return err
+}
+
+func (c *redisClient) do(args ...string) ([]byte, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.roundTrip(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.roundTrip(c.timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.roundTrip(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) roundTrip(timeout time.Duration, args ...string) ([]byte, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, cmd.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() ([]byte, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line[1:])
+		}
+		if size < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisCache stores entries as JSON under "serviceb:<cache>:<key>". With SERVE_STALE, Redis
+// keeps each key MAX_STALE_AGE past its ExpiresAt so GetStale can still find it, and Get checks
+// ExpiresAt itself. Redis being unreachable is never fatal: reads count as misses and writes
+// are dropped, so requests degrade to going straight to the upstream.
+type redisCache[V any] struct {
+	name   string
+	client *redisClient
+}
+
+func newRedisCache[V any](name string, client *redisClient) *redisCache[V] {
+	return &redisCache[V]{name: name, client: client}
+}
+
+func (c *redisCache[V]) key(key string) string {
+	return "serviceb:" + c.name + ":" + key
+}
+
+func (c *redisCache[V]) Get(key string) (cacheEntry[V], bool) {
+	entry, ok := c.load(key)
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "miss").Inc()
+		return cacheEntry[V]{}, false
+	}
+	if entry.Negative {
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "negative_hit").Inc()
+	} else {
+		cacheLookups.WithLabelValues(labelValue("cache", c.name), "hit").Inc()
+	}
+	return entry, true
+}
+
+func (c *redisCache[V]) GetStale(key string, maxAge time.Duration) (cacheEntry[V], bool) {
+	entry, ok := c.load(key)
+	if !ok || entry.Negative || !isStale(entry.ExpiresAt, maxAge) {
+		return cacheEntry[V]{}, false
+	}
+	cacheLookups.WithLabelValues(labelValue("cache", c.name), "stale_hit").Inc()
+	return entry, true
+}
+
+func (c *redisCache[V]) load(key string) (cacheEntry[V], bool) {
+	data, err := c.client.Get(c.key(key))
+	if err != nil {
+		if !errors.Is(err, errRedisNil) {
+			redisErrors.WithLabelValues(labelValue("cache", c.name), "get").Inc()
+		}
+		return cacheEntry[V]{}, false
+	}
+
+	var entry cacheEntry[V]
+	if err := json.Unmarshal(data, &entry); err != nil {
+		redisErrors.WithLabelValues(labelValue("cache", c.name), "decode").Inc()
+		return cacheEntry[V]{}, false
+	}
+	return entry, true
+}
+
+func (c *redisCache[V]) Set(key string, value V, ttl time.Duration) {
+	c.store(key, cacheEntry[V]{Value: value}, ttl)
+}
+
+func (c *redisCache[V]) SetNegative(key string, ttl time.Duration) {
+	c.store(key, cacheEntry[V]{Negative: true}, ttl)
+}
+
+func (c *redisCache[V]) store(key string, entry cacheEntry[V], ttl time.Duration) {
+	ttl = jitterTTL(ttl, cacheTTLJitter)
+	entry.ExpiresAt = time.Now().Add(ttl)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		redisErrors.WithLabelValues(labelValue("cache", c.name), "encode").Inc()
+		return
+	}
+	if serveStale && !entry.Negative {
+		ttl += maxStaleAge
+	}
+	if err := c.client.Set(c.key(key), data, ttl); err != nil {
+		redisErrors.WithLabelValues(labelValue("cache", c.name), "set").Inc()
+	}
+}
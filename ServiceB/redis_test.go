@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis answers RESP commands with reply(args), counting the connections it accepts and
+// recording every command.
+type fakeRedis struct {
+	net.Listener
+	reply func(args []string) string
+
+	mu       sync.Mutex
+	conns    int
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, reply func(args []string) string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{Listener: ln, reply: reply}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRESPArray(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+		io.WriteString(conn, s.reply(args))
+	}
+}
+
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (s *fakeRedis) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *fakeRedis) Commands() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+func TestRedisErrorReplyKeepsConnection(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if args[0] == "SET" {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		if args[1] == "missing" {
+			return "$-1\r\n"
+		}
+		return "$5\r\nhello\r\n"
+	})
+	client, err := newRedisClient("redis://"+server.Addr().String(), time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replyErr redisError
+	if err := client.Set("k", []byte("v"), time.Minute); !errors.As(err, &replyErr) {
+		t.Fatalf("Set error = %v, want the error reply", err)
+	}
+	if _, err := client.Get("missing"); !errors.Is(err, errRedisNil) {
+		t.Fatalf("Get(missing) error = %v, want errRedisNil", err)
+	}
+	if got, err := client.Get("k"); err != nil || string(got) != "hello" {
+		t.Fatalf("Get(k) = %q, %v", got, err)
+	}
+	if n := server.Conns(); n != 1 {
+		t.Errorf("client opened %d connections, want 1 reused across the error reply", n)
+	}
+}
+
+func TestRedisProtocolErrorDropsConnection(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		if args[1] == "garbled" {
+			return "?what\r\n"
+		}
+		return "$-1\r\n"
+	})
+	client, err := newRedisClient("redis://"+server.Addr().String(), time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Get("garbled"); err == nil || errors.Is(err, errRedisNil) {
+		t.Fatalf("Get(garbled) error = %v, want a protocol error", err)
+	}
+	client.Get("next")
+	if n := server.Conns(); n != 2 {
+		t.Errorf("client opened %d connections, want a fresh one after the protocol error", n)
+	}
+}
+
+func TestRedisSetExpiry(t *testing.T) {
+	server := newFakeRedis(t, func(args []string) string {
+		px, err := strconv.Atoi(args[len(args)-1])
+		if err != nil || px <= 0 {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		return "+OK\r\n"
+	})
+	client, err := newRedisClient("redis://"+server.Addr().String(), time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ttl    time.Duration
+		wantPX string // "" means no SET is sent
+	}{
+		{ttl: 90 * time.Second, wantPX: "90000"},
+		{ttl: 1500 * time.Microsecond, wantPX: "1"},
+		{ttl: 300 * time.Microsecond, wantPX: "1"},
+		{ttl: 0},
+		{ttl: -time.Second},
+	}
+	for _, tt := range tests {
+		before := len(server.Commands())
+		if err := client.Set("k", []byte("v"), tt.ttl); err != nil {
+			t.Errorf("Set(ttl %s): %s", tt.ttl, err)
+			continue
+		}
+		commands := server.Commands()[before:]
+		switch {
+		case tt.wantPX == "" && len(commands) != 0:
+			t.Errorf("Set(ttl %s) sent %v, want nothing", tt.ttl, commands)
+		case tt.wantPX != "" && (len(commands) != 1 || strings.Join(commands[0][3:], " ") != "PX "+tt.wantPX):
+			t.Errorf("Set(ttl %s) sent %v, want PX %s", tt.ttl, commands, tt.wantPX)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// codec serializes response bodies in one format.
+type codec interface {
+	ContentType() string
+	Encode(w io.Writer, r *http.Request, v any) error
+}
+
+// jsonCodec is the default. Output is compact unless the caller asks for ?pretty=true, which
+// indents it with two spaces for reading by hand.
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(w io.Writer, r *http.Request, v any) error {
+	enc := json.NewEncoder(w)
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
+
+// msgpackCodec serves clients that send Accept: application/msgpack, for consumers where
+// parsing JSON is the bottleneck.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Encode(w io.Writer, _ *http.Request, v any) error {
+	data, err := marshalMsgpack(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// negotiateCodec picks MessagePack only when the Accept header names it; anything else,
+// including no Accept header at all, gets JSON.
+func negotiateCodec(r *http.Request) codec {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accepted, ";")
+		switch strings.TrimSpace(mediaType) {
+		case "application/msgpack", "application/x-msgpack":
+			return msgpackCodec{}
+		}
+	}
+	return jsonCodec{}
+}
+
+// writeJSON writes v as the response body with the given status, in JSON unless the request
+// negotiated another codec.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	c := negotiateCodec(r)
+	w.Header().Set("Content-Type", c.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	c.Encode(w, r, v)
+}
+
+// Envelope is the shape of a success body under RESPONSE_ENVELOPE: the payload in Data and
+// what produced it in Meta.
+type Envelope struct {
+	Data any          `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta describes an enveloped response. Source is where the data came from: cache,
+// upstream or stale.
+type EnvelopeMeta struct {
+	RequestID string     `json:"request_id,omitempty"`
+	Timestamp jsonTime   `json:"timestamp"`
+	Source    dataSource `json:"source,omitempty"`
+}
+
+// writeData writes a successful temperature payload, wrapped in an Envelope when
+// RESPONSE_ENVELOPE is on and bare otherwise.
+func writeData(w http.ResponseWriter, r *http.Request, status int, v any, source dataSource) {
+	if responseEnvelope {
+		v = Envelope{
+			Data: v,
+			Meta: EnvelopeMeta{
+				RequestID: middleware.GetReqID(r.Context()),
+				Timestamp: jsonTime(time.Now()),
+				Source:    source,
+			},
+		}
+	}
+	writeJSON(w, r, status, v)
+}
+
+// checkNotModified sets Last-Modified and reports whether the request's If-Modified-Since
+// already covers modTime, in which case it has replied 304 and the caller must stop. HTTP dates
+// only carry whole seconds, so modTime is truncated before comparing.
+func checkNotModified(w http.ResponseWriter, r *http.Request, modTime time.Time) bool {
+	modTime = modTime.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// decodeErrorStatus is 422 when the body is well-formed JSON with a value of the wrong type,
+// and 400 when it can't be parsed as JSON at all.
+func decodeErrorStatus(err error) int {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// ErrorResponse is the body of every error reply. Error keeps the English text existing
+// clients match on, Code is the stable machine-readable identifier and Message is the same
+// error in the caller's language (Accept-Language).
+type ErrorResponse struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func newErrorResponse(r *http.Request, code string, args ...any) ErrorResponse {
+	return ErrorResponse{
+		Error:   localize(fallbackLocale, code, args...),
+		Code:    code,
+		Message: localize(negotiateLocale(r.Header.Get("Accept-Language")), code, args...),
+	}
+}
+
+// writeError replies with the message registered for code, formatted with args.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, args ...any) {
+	writeErrorResponse(w, r, status, newErrorResponse(r, code, args...))
+}
+
+// writeErrorDetail is writeError plus a technical, untranslated detail.
+func writeErrorDetail(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	resp := newErrorResponse(r, code)
+	resp.Detail = detail
+	writeErrorResponse(w, r, status, resp)
+}
+
+const (
+	errorFormatSimple  = "simple"
+	errorFormatProblem = "problem"
+)
+
+// Problem is an error body under ERROR_FORMAT=problem, following RFC 7807. Title is the
+// message in the caller's language, Instance the request ID, and Code carries the stable
+// error code as an extension member, as in ErrorResponse.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// problemType is the type URI of an error code: PROBLEM_TYPE_BASE_URI followed by the code,
+// as stable as the code itself.
+func problemType(code string) string {
+	return problemTypeBaseURI + code
+}
+
+func newProblem(r *http.Request, status int, resp ErrorResponse) Problem {
+	return Problem{
+		Type:     problemType(resp.Code),
+		Title:    resp.Message,
+		Status:   status,
+		Detail:   resp.Detail,
+		Instance: middleware.GetReqID(r.Context()),
+		Code:     resp.Code,
+	}
+}
+
+// writeErrorResponse writes resp in the format ERROR_FORMAT picks.
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, resp ErrorResponse) {
+	if errorFormat == errorFormatProblem {
+		writeProblem(w, r, status, newProblem(r, status, resp))
+		return
+	}
+	writeJSON(w, r, status, resp)
+}
+
+// writeProblem writes a Problem, or a type embedding one, as application/problem+json.
+// Problems are always JSON, whatever codec the request negotiated.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	jsonCodec{}.Encode(w, r, v)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransportStatuses(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       string
+		status    int
+		wantCalls int32
+	}{
+		{name: "custom code retried", env: "502,503,504,520", status: 520, wantCalls: 3},
+		{name: "custom code alone", env: "520", status: 520, wantCalls: 3},
+		{name: "default list leaves 520 alone", status: 520, wantCalls: 1},
+		{name: "default list retries 503", status: http.StatusServiceUnavailable, wantCalls: 3},
+		{name: "4xx never retried by default", status: http.StatusTooManyRequests, wantCalls: 1},
+		{name: "custom list replaces the default", env: "520", status: http.StatusServiceUnavailable, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RETRYABLE_STATUS_CODES", tt.env)
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Fails twice, then succeeds.
+				if calls.Add(1) < 3 {
+					w.WriteHeader(tt.status)
+				}
+			}))
+			t.Cleanup(upstream.Close)
+
+			client := &http.Client{Transport: retryTransport{
+				next:     http.DefaultTransport,
+				retries:  func() int { return 2 },
+				statuses: envStatusCodes("RETRYABLE_STATUS_CODES", []int{502, 503, 504}),
+				backoff:  time.Millisecond,
+			}}
+			resp, err := client.Get(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestCepAwesomeapiRetriesCustomStatus(t *testing.T) {
+	isolateRuntimeConfig(t)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Cloudflare's "web server is down", once.
+		if calls.Add(1) == 1 {
+			w.WriteHeader(520)
+			return
+		}
+		http.ServeFile(w, r, "testdata/fixtures/success/awesomeapi.json")
+	}))
+	t.Cleanup(upstream.Close)
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+	setForTest(t, &retryableStatusCodes, map[int]bool{520: true})
+	setForTest(t, &upstreamClient, newUpstreamClient())
+	if rec := postConfig(t, `{"upstream_retries":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/config: %d %s", rec.Code, rec.Body)
+	}
+
+	got, err := CepAwesomeapi(context.Background(), "01001000")
+	if err != nil || got.City != "São Paulo" {
+		t.Fatalf("CepAwesomeapi = %+v, %v, want the retried answer", got, err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("awesomeapi called %d times, want 2", n)
+	}
+}
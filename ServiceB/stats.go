@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const statsDateLayout = "2006-01-02"
+
+// ArchiveResponse is the part of open-meteo's historical weather API the stats use. Days the
+// archive has no data for come back as null.
+type ArchiveResponse struct {
+	Daily struct {
+		Temperature2MMean []*float64 `json:"temperature_2m_mean"`
+	} `json:"daily"`
+}
+
+// TemperatureStats aggregates the daily mean temperature over [from, to]. Days counts the
+// days with data, which can be fewer than the range when the archive has gaps.
+type TemperatureStats struct {
+	City    string  `json:"city"`
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Days    int     `json:"days"`
+	MeanC   float64 `json:"mean_C"`
+	MinC    float64 `json:"min_C"`
+	MaxC    float64 `json:"max_C"`
+	StddevC float64 `json:"stddev_C"`
+}
+
+// parseStatsRange reads ?from= and ?to=. Both must be dates before today (UTC), from no later
+// than to, and the range no longer than maxDays days, both ends included.
+func parseStatsRange(r *http.Request, maxDays int) (from, to time.Time, ok bool) {
+	from, err := time.Parse(statsDateLayout, r.URL.Query().Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	to, err = time.Parse(statsDateLayout, r.URL.Query().Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	days := int(to.Sub(from)/(24*time.Hour)) + 1
+	if from.After(to) || !to.Before(today) || days > maxDays {
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// summarize computes the mean, extremes and population standard deviation of the values
+// present, skipping nulls. n is how many values were used; with none, the rest is zero.
+func summarize(values []*float64) (mean, minimum, maximum, stddev float64, n int) {
+	var sum float64
+	minimum, maximum = math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		n++
+		sum += *v
+		minimum, maximum = min(minimum, *v), max(maximum, *v)
+	}
+	if n == 0 {
+		return 0, 0, 0, 0, 0
+	}
+	mean = sum / float64(n)
+
+	var squares float64
+	for _, v := range values {
+		if v != nil {
+			squares += (*v - mean) * (*v - mean)
+		}
+	}
+	return mean, minimum, maximum, math.Sqrt(squares / float64(n)), n
+}
+
+// HandlerStats returns statistics of the daily mean temperature at a CEP over a past date range.
+func HandlerStats(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.HeaderCarrier(r.Header)
+	ctx := r.Context()
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "HandlerStats")
+	defer span.End()
+
+	cep, err := parseCep(chi.URLParam(r, "cep"))
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidZipcode)
+		return
+	}
+	from, to, ok := parseStatsRange(r, statsMaxDays)
+	if !ok {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidDateRange, statsMaxDays)
+		return
+	}
+
+	cepResponse, _, err := LookupCepLocation(ctx, cep)
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	latitude, longitude, _, err := weatherCoordinates(ctx, cepResponse)
+	if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	archive, err := WeatherArchive(ctx, latitude, longitude, from, to)
+	if err != nil {
+		logFromCtx(ctx).Warn("archive lookup failed", slog.String("error", err.Error()))
+		writeLookupError(w, r, err)
+		return
+	}
+
+	mean, minimum, maximum, stddev, n := summarize(archive.Daily.Temperature2MMean)
+	if n == 0 {
+		writeError(w, r, http.StatusUnprocessableEntity, codeWeatherUnavailable)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, TemperatureStats{
+		City:    cepResponse.City,
+		From:    from.Format(statsDateLayout),
+		To:      to.Format(statsDateLayout),
+		Days:    n,
+		MeanC:   mean,
+		MinC:    minimum,
+		MaxC:    maximum,
+		StddevC: stddev,
+	})
+}
+
+// WeatherArchive fetches the daily mean temperature between from and to, in the location's
+// own time zone so each day is a local calendar day.
+func WeatherArchive(ctx context.Context, latitude, longitude string, from, to time.Time) (*ArchiveResponse, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "WeatherArchive")
+	defer span.End()
+
+	query := url.Values{
+		"latitude":   {latitude},
+		"longitude":  {longitude},
+		"start_date": {from.Format(statsDateLayout)},
+		"end_date":   {to.Format(statsDateLayout)},
+		"daily":      {"temperature_2m_mean"},
+		"timezone":   {"auto"},
+	}
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "openmeteo-archive"), "GET", openMeteoArchiveBaseURL+"/v1/archive?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("openmeteo-archive", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("openmeteo-archive", resp, body, fmt.Errorf("archive api returned %d", resp.StatusCode))
+	}
+
+	var archive ArchiveResponse
+	if err := decodeUpstreamJSON("openmeteo-archive", resp, body, &archive); err != nil {
+		return nil, err
+	}
+	return &archive, nil
+}
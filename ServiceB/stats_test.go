@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestSummarize(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	mean, minimum, maximum, stddev, n := summarize([]*float64{value(20), nil, value(22), value(18), nil, value(24)})
+	if n != 4 || mean != 21 || minimum != 18 || maximum != 24 || math.Abs(stddev-math.Sqrt(5)) > 1e-9 {
+		t.Errorf("summarize = mean %v, min %v, max %v, stddev %v, n %d; want 21, 18, 24, √5, 4", mean, minimum, maximum, stddev, n)
+	}
+
+	if mean, minimum, maximum, stddev, n := summarize([]*float64{nil, nil}); n != 0 || mean != 0 || minimum != 0 || maximum != 0 || stddev != 0 {
+		t.Errorf("summarize(all null) = %v %v %v %v %d, want zeros", mean, minimum, maximum, stddev, n)
+	}
+}
+
+func TestParseStatsRange(t *testing.T) {
+	today := time.Now().UTC()
+	day := func(offset int) string { return today.AddDate(0, 0, offset).Format(statsDateLayout) }
+	tests := []struct {
+		name     string
+		from, to string
+		want     bool
+	}{
+		{name: "a past week", from: day(-8), to: day(-1), want: true},
+		{name: "a single day", from: day(-1), to: day(-1), want: true},
+		{name: "exactly the maximum", from: day(-10), to: day(-1), want: true},
+		{name: "one day over the maximum", from: day(-11), to: day(-1)},
+		{name: "ending today", from: day(-3), to: day(0)},
+		{name: "in the future", from: day(1), to: day(2)},
+		{name: "from after to", from: day(-1), to: day(-3)},
+		{name: "missing to", from: day(-3)},
+		{name: "not a date", from: "01/05/2024", to: day(-1)},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/01001000/stats?from="+tt.from+"&to="+tt.to, nil)
+		if _, _, ok := parseStatsRange(r, 10); ok != tt.want {
+			t.Errorf("%s (%s to %s): ok = %v, want %v", tt.name, tt.from, tt.to, ok, tt.want)
+		}
+	}
+}
+
+func TestHandlerStats(t *testing.T) {
+	newFixtureServer(t, "success")
+	var query map[string][]string
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"daily":{"time":["a","b","c","d"],"temperature_2m_mean":[20,null,22,24]}}`))
+	}))
+	t.Cleanup(archive.Close)
+	setForTest(t, &openMeteoArchiveBaseURL, archive.URL)
+	setForTest(t, &statsMaxDays, 30)
+
+	router := chi.NewRouter()
+	router.Get("/{cep}/stats", HandlerStats)
+	from := time.Now().UTC().AddDate(0, 0, -4).Format(statsDateLayout)
+	to := time.Now().UTC().AddDate(0, 0, -1).Format(statsDateLayout)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/01001000/stats?from="+from+"&to="+to, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var got TemperatureStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %s: %s", rec.Body, err)
+	}
+	// The null day is left out rather than counted as 0°C.
+	if got.City != "São Paulo" || got.From != from || got.To != to || got.Days != 3 || got.MeanC != 22 || got.MinC != 20 || got.MaxC != 24 {
+		t.Errorf("got %+v", got)
+	}
+	if query["start_date"][0] != from || query["end_date"][0] != to || query["latitude"][0] != "-23.5502784" {
+		t.Errorf("archive queried with %v", query)
+	}
+
+	// Past STATS_MAX_DAYS, the archive isn't asked at all.
+	query = nil
+	from = time.Now().UTC().AddDate(0, 0, -31).Format(statsDateLayout)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/01001000/stats?from="+from+"&to="+to, nil))
+	var body ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusUnprocessableEntity || body.Code != codeInvalidDateRange || query != nil {
+		t.Errorf("31 days: status = %d, body %s, want 422 %q without an archive call", rec.Code, rec.Body, codeInvalidDateRange)
+	}
+}
+
+func TestHandlerStatsArchiveTimeout(t *testing.T) {
+	newFixtureServer(t, "success")
+	release := make(chan struct{})
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(archive.Close)
+	t.Cleanup(func() { close(release) })
+	setForTest(t, &openMeteoArchiveBaseURL, archive.URL)
+
+	router := chi.NewRouter()
+	router.Get("/{cep}/stats", HandlerStats)
+	from := time.Now().UTC().AddDate(0, 0, -4).Format(statsDateLayout)
+	to := time.Now().UTC().AddDate(0, 0, -1).Format(statsDateLayout)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequestWithContext(ctx, http.MethodGet, "/01001000/stats?from="+from+"&to="+to, nil))
+	var body ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusGatewayTimeout || body.Code != codeUpstreamTimeout {
+		t.Errorf("status = %d, body %s, want 504 %q like GET /{cep}", rec.Code, rec.Body, codeUpstreamTimeout)
+	}
+}
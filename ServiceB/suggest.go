@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// CepSuggestion is an existing CEP close to one that wasn't found.
+type CepSuggestion struct {
+	Cep   string `json:"cep"`
+	City  string `json:"city"`
+	State string `json:"state"`
+}
+
+// NotFoundResponse is the 404 body for ?suggest=true: the usual error plus suggestions.
+type NotFoundResponse struct {
+	ErrorResponse
+	Suggestions []CepSuggestion `json:"suggestions"`
+}
+
+// suggestionCandidates are the CEPs that share progressively shorter prefixes with cep and
+// end in zeros. Those are the ones most likely to exist: a locality's general CEP, then its
+// sector's, then its region's.
+func suggestionCandidates(cep string) []string {
+	var candidates []string
+	for _, prefix := range []int{5, 4, 3} {
+		candidate := cep[:prefix] + strings.Repeat("0", len(cep)-prefix)
+		if candidate != cep && (len(candidates) == 0 || candidates[len(candidates)-1] != candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// suggestCeps looks up the candidates for a CEP that wasn't found and returns those that
+// exist. Lookups go through the CEP cache, so repeated misses in one area stay cheap.
+func suggestCeps(ctx context.Context, cep string) []CepSuggestion {
+	suggestions := []CepSuggestion{}
+	if len(cep) < 8 {
+		return suggestions
+	}
+	for _, candidate := range suggestionCandidates(cep) {
+		cepResponse, _, err := LookupCep(ctx, candidate)
+		if err != nil {
+			if !errors.Is(err, errCepNotFound) {
+				break
+			}
+			continue
+		}
+		suggestions = append(suggestions, CepSuggestion{Cep: cepResponse.Cep, City: cepResponse.City, State: cepResponse.State})
+	}
+	return suggestions
+}
+
+// NotFoundProblem is NotFoundResponse under ERROR_FORMAT=problem, with the suggestions as an
+// extension member.
+type NotFoundProblem struct {
+	Problem
+	Suggestions []CepSuggestion `json:"suggestions"`
+}
+
+// writeNotFoundWithSuggestions replies 404 zipcode_not_found with suggestions for cep.
+func writeNotFoundWithSuggestions(ctx context.Context, w http.ResponseWriter, r *http.Request, cep string) {
+	resp := newErrorResponse(r, codeZipcodeNotFound)
+	suggestions := suggestCeps(ctx, cep)
+	if errorFormat == errorFormatProblem {
+		writeProblem(w, r, http.StatusNotFound, NotFoundProblem{
+			Problem:     newProblem(r, http.StatusNotFound, resp),
+			Suggestions: suggestions,
+		})
+		return
+	}
+	writeJSON(w, r, http.StatusNotFound, NotFoundResponse{
+		ErrorResponse: resp,
+		Suggestions:   suggestions,
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatUnix    = "unix"
+)
+
+// jsonTime is a timestamp in a response, serialized as TIME_FORMAT says: an RFC 3339 string,
+// or with "unix", whole seconds since the epoch.
+type jsonTime time.Time
+
+func newJSONTime(t time.Time) *jsonTime {
+	jt := jsonTime(t)
+	return &jt
+}
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	if timeFormat == timeFormatUnix {
+		return json.Marshal(time.Time(t).Unix())
+	}
+	return time.Time(t).MarshalJSON()
+}
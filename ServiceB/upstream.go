@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamSnippetBytes = 200
+	maxUpstreamRedirects = 3
+)
+
+// upstreamError is an upstream answer we couldn't use: an unexpected status or a body that
+// isn't the JSON we asked for (e.g. an HTML error page from a CDN). It maps to 502 rather
+// than being mistaken for a CEP that doesn't exist.
+type upstreamError struct {
+	Provider   string
+	StatusCode int
+	Err        error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Provider, e.Err)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.Err
+}
+
+// newUpstreamError logs the response's content type and the start of its body, which is
+// usually enough to tell a maintenance page from a real API error.
+func newUpstreamError(provider string, resp *http.Response, body []byte, err error) *upstreamError {
+	snippet := body
+	if len(snippet) > upstreamSnippetBytes {
+		snippet = snippet[:upstreamSnippetBytes]
+	}
+	logFromCtx(resp.Request.Context()).Warn("unusable upstream response",
+		slog.String("provider", provider),
+		slog.String("error", err.Error()),
+		slog.Int("status", resp.StatusCode),
+		slog.String("content_type", resp.Header.Get("Content-Type")),
+		slog.String("body", string(snippet)),
+	)
+	return &upstreamError{Provider: provider, StatusCode: resp.StatusCode, Err: err}
+}
+
+// decodeUpstreamJSON unmarshals an upstream body into v, rejecting non-JSON content types.
+// A missing Content-Type is tolerated as long as the body decodes.
+func decodeUpstreamJSON(provider string, resp *http.Response, body []byte, v any) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "" && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return newUpstreamError(provider, resp, body, fmt.Errorf("unexpected content type %q", mediaType))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return newUpstreamError(provider, resp, body, fmt.Errorf("invalid JSON: %w", err))
+	}
+	return nil
+}
+
+// upstreamClient is shared by every outbound call so connections are reused. Connecting,
+// the TLS handshake and waiting for response headers each have their own limit, so an
+// unreachable upstream fails fast while a slow-but-alive one still gets the full timeout.
+var upstreamClient = newUpstreamClient()
+
+// upstreamLimiter enforces UPSTREAM_MAX_CONCURRENCY, or its /admin/config override, on every
+// upstream call.
+var upstreamLimiter = newFairLimiter(upstreamMaxConcurrency, upstreamTenantMaxConcurrency)
+
+func newUpstreamClient() *http.Client {
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	transport.TLSClientConfig = &tls.Config{MinVersion: minTLSVersion}
+	// The cloned transport already honors HTTP_PROXY/HTTPS_PROXY/NO_PROXY; UPSTREAM_PROXY_URL
+	// sends every upstream call through one proxy regardless (http, https or socks5).
+	if upstreamProxyURL != "" {
+		proxyURL, err := url.Parse(upstreamProxyURL)
+		if err == nil && proxyURL.Host != "" {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		} else {
+			log.Printf("ignoring invalid UPSTREAM_PROXY_URL %q", upstreamProxyURL)
+		}
+	}
+
+	// The CEP and weather chains set their own deadlines per call; the per-call limit must not
+	// cut those short when one is configured above UPSTREAM_TIMEOUT.
+	timeout := max(upstreamTimeout, cepAPITimeout, weatherAPITimeout)
+	client := &http.Client{
+		Transport:     budgetTransport{next: transport, timeout: timeout, headerTimeout: responseHeaderTimeout},
+		CheckRedirect: checkUpstreamRedirect,
+	}
+	// Inside the limiter and the retries, so each attempt is timed on its own and neither the
+	// wait for a slot nor the backoff counts as upstream latency.
+	client.Transport = latencyTransport{next: client.Transport}
+	// Both are always in place, since /admin/config can turn on a limit or retries the
+	// environment left off.
+	client.Transport = limitedTransport{next: client.Transport, limiter: upstreamLimiter}
+	// Outside the limiter, so a retry waits for a slot like any other call.
+	client.Transport = retryTransport{
+		next:     client.Transport,
+		retries:  func() int { return runtimeConfig.Load().UpstreamRetries },
+		statuses: retryableStatusCodes,
+		backoff:  upstreamRetryBackoff,
+	}
+	return client
+}
+
+// errResponseHeaderTimeout is how budgetTransport reports RESPONSE_HEADER_TIMEOUT running out.
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// timedOut reports whether err is a call running out of time or being canceled: the
+// request's own context, one of our per-call limits, or the transport's. It is not the
+// upstream's answer, so it must not read as one (e.g. a CEP that doesn't exist).
+func timedOut(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, errResponseHeaderTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// budgetTransport limits each upstream call to timeout, and the wait for its response headers
+// to headerTimeout. It takes the place of http.Client.Timeout and the transport's
+// ResponseHeaderTimeout, which are fixed for the client, so that a request given a longer
+// X-Request-Timeout gets the longer limits; see upstreamBudget.
+type budgetTransport struct {
+	next          http.RoundTripper
+	timeout       time.Duration
+	headerTimeout time.Duration
+}
+
+func (t budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	ctx, cancelHeaders := context.WithCancelCause(parent)
+	ctx, cancel := context.WithTimeout(ctx, upstreamBudget(parent, t.timeout))
+	release := func() {
+		cancel()
+		cancelHeaders(nil)
+	}
+	headers := time.AfterFunc(upstreamBudget(parent, t.headerTimeout), func() { cancelHeaders(errResponseHeaderTimeout) })
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	headers.Stop()
+	if err != nil {
+		// Report our own limits rather than a bare "context canceled".
+		if cause := context.Cause(ctx); cause != nil && parent.Err() == nil {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+		release()
+		return nil, err
+	}
+	// The limit covers reading the body too, so it is only released once that is closed.
+	resp.Body = releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+type upstreamProviderKey struct{}
+
+// withUpstreamProvider names the provider a request is for, which latencyTransport labels its
+// attempts with.
+func withUpstreamProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, upstreamProviderKey{}, provider)
+}
+
+// latencyTransport records every attempt at an upstream call in upstreamRequestDuration, from
+// sending the request until its body is closed, with how it ended: "timeout" (see timedOut),
+// "error" for any other failure, and "ok" for a response read through, whatever its status.
+// Requests without a provider, such as the /status probes, aren't recorded.
+type latencyTransport struct {
+	next http.RoundTripper
+}
+
+func (t latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	provider, ok := req.Context().Value(upstreamProviderKey{}).(string)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	start := time.Now()
+	observe := func(err error) {
+		outcome := "ok"
+		switch {
+		case timedOut(err):
+			outcome = "timeout"
+		case err != nil:
+			outcome = "error"
+		}
+		upstreamRequestDuration.WithLabelValues(labelValue("provider", provider), outcome).Observe(time.Since(start).Seconds())
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		observe(err)
+		return nil, err
+	}
+	resp.Body = &observedBody{ReadCloser: resp.Body, observe: observe}
+	return resp, nil
+}
+
+// observedBody reports the first error reading it, if any, once it is closed.
+type observedBody struct {
+	io.ReadCloser
+	observe func(err error)
+	err     error
+	once    sync.Once
+}
+
+func (b *observedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *observedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.observe(b.err) })
+	return err
+}
+
+// checkUpstreamRedirect follows a few redirects within the host we asked, e.g. http to https.
+// A redirect to another host is what a provider's maintenance page looks like, so it fails
+// as an upstream error instead of feeding someone else's HTML to the JSON decoder.
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	origin := via[0].URL
+	var err error
+	switch {
+	case len(via) > maxUpstreamRedirects:
+		err = fmt.Errorf("stopped after %d redirects", maxUpstreamRedirects)
+	case req.URL.Hostname() != origin.Hostname():
+		err = fmt.Errorf("redirected off %s to %s", origin.Hostname(), req.URL.Redacted())
+	default:
+		return nil
+	}
+
+	logFromCtx(req.Context()).Warn("unusable upstream redirect",
+		slog.String("host", origin.Hostname()),
+		slog.String("error", err.Error()),
+	)
+	return &upstreamError{Provider: origin.Hostname(), StatusCode: req.Response.StatusCode, Err: err}
+}
+
+// readUpstreamBody reads at most maxUpstreamBodyBytes from an upstream response. A body that
+// doesn't fit is reported as an error rather than silently truncated, since a cut-off JSON
+// document can't be decoded anyway.
+func readUpstreamBody(provider string, body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, int64(maxUpstreamBodyBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	upstreamResponseBytes.WithLabelValues(labelValue("provider", provider)).Observe(float64(len(data)))
+	if len(data) > maxUpstreamBodyBytes {
+		return nil, fmt.Errorf("upstream response exceeds %d bytes", maxUpstreamBodyBytes)
+	}
+	return data, nil
+}
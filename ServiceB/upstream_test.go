@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const htmlErrorPage = `<!DOCTYPE html><html><head><title>502: Bad gateway</title></head><body><h1>Bad gateway</h1></body></html>`
+
+func TestHandlerCepHTMLUpstreamIsBadGateway(t *testing.T) {
+	tests := []struct {
+		name        string
+		htmlPrefix  string
+		contentType string
+	}{
+		{name: "awesomeapi text/html", htmlPrefix: "/json/", contentType: "text/html; charset=UTF-8"},
+		{name: "awesomeapi HTML labeled JSON", htmlPrefix: "/json/", contentType: "application/json"},
+		{name: "open-meteo text/html", htmlPrefix: "/v1/forecast", contentType: "text/html; charset=UTF-8"},
+		{name: "open-meteo HTML labeled JSON", htmlPrefix: "/v1/forecast", contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, tt.htmlPrefix) {
+					w.Header().Set("Content-Type", tt.contentType)
+					w.Write([]byte(htmlErrorPage))
+					return
+				}
+				file := "success/awesomeapi.json"
+				if strings.HasPrefix(r.URL.Path, "/v1/forecast") {
+					file = "success/openmeteo.json"
+				}
+				body, err := os.ReadFile(filepath.Join("testdata", "fixtures", file))
+				if err != nil {
+					t.Errorf("reading fixture: %s", err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write(body)
+			}))
+			t.Cleanup(upstream.Close)
+			isolateUpstreams(t)
+			setForTest(t, &awesomeapiBaseURL, upstream.URL)
+			setForTest(t, &openMeteoBaseURL, upstream.URL)
+
+			rec := serveCep(t, "/01001000")
+			var body ErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if rec.Code != http.StatusBadGateway || body.Code != codeUpstreamError {
+				t.Errorf("status = %d, body %s, want 502 %q", rec.Code, rec.Body, codeUpstreamError)
+			}
+		})
+	}
+}
+
+func TestCepAwesomeapiRedirects(t *testing.T) {
+	success, err := os.ReadFile(filepath.Join("testdata", "fixtures", "success", "awesomeapi.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The maintenance page lives on another host; localhost and 127.0.0.1 are the same server
+	// but not the same host to the client.
+	var maintenance string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/01001000":
+			http.Redirect(w, r, "/v2/json/01001000", http.StatusMovedPermanently)
+		case "/v2/json/01001000":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(success)
+		case "/json/02002000":
+			http.Redirect(w, r, maintenance, http.StatusFound)
+		case "/maintenance":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(htmlErrorPage))
+		default:
+			// Every other CEP redirects to itself forever.
+			http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	maintenance = strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1) + "/maintenance"
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+
+	if got, err := CepAwesomeapi(context.Background(), "01001000"); err != nil || got.City != "São Paulo" {
+		t.Errorf("redirect within the host: got %+v, %v, want it followed", got, err)
+	}
+
+	for cep, want := range map[string]string{
+		"02002000": "redirected off 127.0.0.1",
+		"03003000": "stopped after 3 redirects",
+	} {
+		_, err := CepAwesomeapi(context.Background(), cep)
+		var upErr *upstreamError
+		if !errors.As(err, &upErr) || !strings.Contains(err.Error(), want) {
+			t.Errorf("CEP %s: err = %v, want an upstream error containing %q", cep, err, want)
+		}
+
+		rec := serveCep(t, "/"+cep)
+		var body ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != http.StatusBadGateway || body.Code != codeUpstreamError {
+			t.Errorf("GET /%s: status = %d, body %s, want 502 %q", cep, rec.Code, rec.Body, codeUpstreamError)
+		}
+	}
+}
+
+func TestUpstreamProxyURLCarriesEveryProvider(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		hosts []string
+	)
+	// A plain HTTP proxy gets the absolute URL in the request line; this one answers from the
+	// fixtures itself instead of forwarding.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mu.Unlock()
+		file := "success/awesomeapi.json"
+		if strings.HasPrefix(r.URL.Path, "/v1/forecast") {
+			file = "success/openmeteo.json"
+		}
+		body, err := os.ReadFile(filepath.Join("testdata", "fixtures", file))
+		if err != nil {
+			t.Errorf("reading fixture: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(proxy.Close)
+	isolateUpstreams(t)
+	// Neither host resolves, so a call that skipped the proxy fails.
+	setForTest(t, &awesomeapiBaseURL, "http://awesomeapi.invalid")
+	setForTest(t, &openMeteoBaseURL, "http://open-meteo.invalid")
+	setForTest(t, &upstreamProxyURL, proxy.URL)
+	setForTest(t, &upstreamClient, newUpstreamClient())
+
+	rec := serveCep(t, "/01001000")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(hosts, []string{"awesomeapi.invalid", "open-meteo.invalid"}) {
+		t.Errorf("proxy saw hosts %v, want awesomeapi then open-meteo", hosts)
+	}
+}
+
+// upstreamAttempts scrapes how many upstream_request_duration_seconds samples provider has
+// with outcome.
+func upstreamAttempts(t *testing.T, provider, outcome string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(metricsRegistry).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	line := regexp.MustCompile(fmt.Sprintf(`(?m)^upstream_request_duration_seconds_count\{outcome="%s",provider="%s"\} (\d+)$`, outcome, provider))
+	m := line.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+func TestUpstreamLatencyIsRecordedPerAttempt(t *testing.T) {
+	isolateRuntimeConfig(t)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json/01001000":
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			http.ServeFile(w, r, "testdata/fixtures/success/awesomeapi.json")
+		case "/json/02002000":
+			<-release
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+	isolateUpstreams(t)
+	setForTest(t, &awesomeapiBaseURL, upstream.URL)
+	setForTest(t, &upstreamClient, newUpstreamClient())
+	if rec := postConfig(t, `{"upstream_retries":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST /admin/config: %d %s", rec.Code, rec.Body)
+	}
+
+	ok, timeout, failed := upstreamAttempts(t, "awesomeapi", "ok"), upstreamAttempts(t, "awesomeapi", "timeout"), upstreamAttempts(t, "awesomeapi", "error")
+
+	// The 503 and its retry are two attempts, each answered.
+	if _, err := CepAwesomeapi(context.Background(), "01001000"); err != nil {
+		t.Fatalf("CepAwesomeapi: %v", err)
+	}
+	if got := upstreamAttempts(t, "awesomeapi", "ok"); got != ok+2 {
+		t.Errorf("ok attempts = %d, want %d", got, ok+2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := CepAwesomeapi(ctx, "02002000"); !timedOut(err) {
+		t.Fatalf("CepAwesomeapi on a stalled upstream: err = %v, want a timeout", err)
+	}
+	if got := upstreamAttempts(t, "awesomeapi", "timeout"); got != timeout+1 {
+		t.Errorf("timeout attempts = %d, want %d", got, timeout+1)
+	}
+
+	// Nothing listens here, so the dial is refused; only statuses are retried.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	setForTest(t, &awesomeapiBaseURL, closed.URL)
+	if _, err := CepAwesomeapi(context.Background(), "01001000"); err == nil {
+		t.Fatal("CepAwesomeapi on a closed port succeeded")
+	}
+	if got := upstreamAttempts(t, "awesomeapi", "error"); got != failed+1 {
+		t.Errorf("error attempts = %d, want %d", got, failed+1)
+	}
+}
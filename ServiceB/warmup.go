@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	warmupRunning = "running"
+	warmupDone    = "done"
+
+	// maxWarmupJobs finished jobs are kept for polling; older ones are forgotten.
+	maxWarmupJobs = 100
+)
+
+type WarmupRequest struct {
+	Ceps []string `json:"ceps"`
+}
+
+// WarmupJob is the progress of one warmup. Succeeded counts CEPs now in the cache, negative
+// entries included; Failed counts invalid CEPs and lookups that errored.
+type WarmupJob struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Succeeded  int       `json:"succeeded"`
+	Failed     int       `json:"failed"`
+	StartedAt  jsonTime  `json:"started_at"`
+	FinishedAt *jsonTime `json:"finished_at,omitempty"`
+}
+
+// warmupJobs tracks warmups started through the admin API.
+type warmupJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*WarmupJob
+	order []string
+}
+
+var warmups = &warmupJobs{jobs: make(map[string]*WarmupJob)}
+
+func (j *warmupJobs) start(total int) WarmupJob {
+	job := &WarmupJob{ID: newJobID(), Status: warmupRunning, Total: total, StartedAt: jsonTime(time.Now().UTC())}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	for len(j.order) > maxWarmupJobs && j.jobs[j.order[0]].Status == warmupDone {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+	return *job
+}
+
+func (j *warmupJobs) get(id string) (WarmupJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return WarmupJob{}, false
+	}
+	return *job, true
+}
+
+func (j *warmupJobs) record(id string, ok bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.jobs[id]
+	job.Done++
+	if ok {
+		job.Succeeded++
+	} else {
+		job.Failed++
+	}
+}
+
+func (j *warmupJobs) finish(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jobs[id].Status, j.jobs[id].FinishedAt = warmupDone, newJSONTime(time.Now().UTC())
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// warmCepCache loads ceps into the CEP cache, at most concurrency lookups at a time, and
+// reports each outcome to done. A CEP confirmed not to exist is cached too and counts as
+// warmed.
+func warmCepCache(ctx context.Context, ceps []string, concurrency int, done func(ok bool)) {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, raw := range ceps {
+		cep, err := parseCep(raw)
+		if err != nil {
+			done(false)
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			_, _, err := LookupCep(ctx, cep)
+			done(err == nil || errors.Is(err, errCepNotFound))
+		})
+	}
+	wg.Wait()
+}
+
+// HandlerStartWarmup accepts {"ceps": [...]}, starts warming them in the background and
+// replies 202 with the job to poll at GET /admin/warmup/{id}.
+func HandlerStartWarmup(w http.ResponseWriter, r *http.Request) {
+	var data WarmupRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeErrorDetail(w, r, decodeErrorStatus(err), codeInvalidPayload, err.Error())
+		return
+	}
+	if len(data.Ceps) == 0 || len(data.Ceps) > warmupMaxCeps {
+		writeError(w, r, http.StatusUnprocessableEntity, codeInvalidBatchSize, warmupMaxCeps)
+		return
+	}
+
+	job := warmups.start(len(data.Ceps))
+	go func() {
+		// Detached from the request: the job outlives the 202 reply.
+		warmCepCache(context.Background(), data.Ceps, warmupConcurrency, func(ok bool) { warmups.record(job.ID, ok) })
+		warmups.finish(job.ID)
+	}()
+
+	w.Header().Set("Location", "/admin/warmup/"+job.ID)
+	writeJSON(w, r, http.StatusAccepted, job)
+}
+
+func HandlerGetWarmup(w http.ResponseWriter, r *http.Request) {
+	job, ok := warmups.get(chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, codeWarmupNotFound)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, job)
+}
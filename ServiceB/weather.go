@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errInvalidCoordinates         = errors.New("invalid coordinates")
+	errNoWeatherProviderAvailable = errors.New("no weather provider available")
+	errNoWeatherCoverage          = errors.New("weather not available for this location")
+	errNoCurrentConditions        = errors.New("response has no current conditions")
+)
+
+// WeatherProvider returns the current weather at a coordinate, normalized to open-meteo's
+// response shape. model is an open-meteo model ID, "" for its best match, and vars are extra
+// open-meteo "current" variables; a provider that can't honor them ignores the model and
+// leaves the variables unset rather than failing.
+type WeatherProvider interface {
+	Name() string
+	Current(ctx context.Context, latitude, longitude, model string, vars []string) (*WeatherApiResponse, error)
+}
+
+type openMeteoProvider struct{}
+
+func (openMeteoProvider) Name() string { return "openmeteo" }
+
+func (openMeteoProvider) Current(ctx context.Context, latitude, longitude, model string, vars []string) (*WeatherApiResponse, error) {
+	return WeatherApi(ctx, latitude, longitude, model, vars...)
+}
+
+// weatherModels are the values ?model= accepts, mapped to open-meteo's model IDs.
+var weatherModels = map[string]string{
+	"best_match":  "best_match",
+	"ecmwf":       "ecmwf_ifs025",
+	"gfs":         "gfs_seamless",
+	"icon":        "icon_seamless",
+	"gem":         "gem_seamless",
+	"jma":         "jma_seamless",
+	"meteofrance": "meteofrance_seamless",
+	"ukmo":        "ukmo_seamless",
+	"metno":       "metno_seamless",
+}
+
+// parseWeatherModel reads ?model=. An absent model is "" (open-meteo's best match); ok is
+// false for a name not in weatherModels.
+func parseWeatherModel(r *http.Request) (model string, ok bool) {
+	name := r.URL.Query().Get("model")
+	if name == "" {
+		return "", true
+	}
+	model, ok = weatherModels[name]
+	return model, ok
+}
+
+type guardedWeatherProvider struct {
+	WeatherProvider
+	breaker *circuitBreaker
+	timeout *adaptiveTimeout
+}
+
+var weatherProviders = newWeatherProviders(envList("WEATHER_PROVIDERS", []string{"openmeteo", "openweathermap"}))
+
+// weatherCache holds current conditions for WEATHER_CACHE_TTL, keyed by weatherCacheKey.
+var weatherCache = newCache[cachedWeather]("weather")
+
+// cachedWeather is a LookupWeather result.
+type cachedWeather struct {
+	Weather  WeatherApiResponse `json:"weather"`
+	Provider string             `json:"provider"`
+	Degraded bool               `json:"degraded"`
+}
+
+func weatherCacheKey(latitude, longitude, model string, vars []string) string {
+	return strings.Join([]string{latitude, longitude, model, currentVariables(vars), dailyVariables(vars)}, "|")
+}
+
+// knownWeatherVars are the open-meteo "current" variables WEATHER_CURRENT_VARS may name.
+var knownWeatherVars = setOf(
+	"temperature_2m", "relative_humidity_2m", "apparent_temperature", "dew_point_2m",
+	"is_day", "precipitation", "rain", "showers", "snowfall", "weather_code", "cloud_cover",
+	"pressure_msl", "surface_pressure", "visibility", "uv_index",
+	"wind_speed_10m", "wind_direction_10m", "wind_gusts_10m",
+)
+
+// newWeatherCurrentVars keeps the names in knownWeatherVars, logging and skipping the rest.
+func newWeatherCurrentVars(names []string) []string {
+	var vars []string
+	for _, name := range names {
+		if !knownWeatherVars[name] {
+			log.Printf("ignoring unknown weather variable %q", name)
+			continue
+		}
+		vars = append(vars, name)
+	}
+	return vars
+}
+
+var dailyWeatherVars = setOf(weatherVarSunrise, weatherVarSunset)
+
+// currentVariables is the value of open-meteo's current= parameter: the temperatures every
+// response needs, then WEATHER_CURRENT_VARS, then the current variables in vars, each named once.
+func currentVariables(vars []string) string {
+	names := slices.Concat([]string{"temperature_2m", "apparent_temperature"}, weatherCurrentVars, vars)
+	return joinUnique(slices.DeleteFunc(names, func(name string) bool { return dailyWeatherVars[name] }))
+}
+
+// dailyVariables is the value of open-meteo's daily= parameter, "" when vars has no daily
+// variable.
+func dailyVariables(vars []string) string {
+	return joinUnique(slices.DeleteFunc(slices.Clone(vars), func(name string) bool { return !dailyWeatherVars[name] }))
+}
+
+func joinUnique(names []string) string {
+	var unique []string
+	for _, name := range names {
+		if !slices.Contains(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	return strings.Join(unique, ",")
+}
+
+// flexNumber decodes a number whether the upstream sent it as an integer, a float or a
+// numeric string, so a change in how it formats a field doesn't fail the whole lookup.
+type flexNumber float64
+
+func (n *flexNumber) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	value, err := strconv.ParseFloat(strings.Trim(string(data), `"`), 64)
+	if err != nil {
+		return fmt.Errorf("not a number: %s", data)
+	}
+	*n = flexNumber(value)
+	return nil
+}
+
+// UnmarshalJSON decodes the typed fields, then collects the numeric values of the variables in
+// WEATHER_CURRENT_VARS into Extra. Nulls are left out. Interval and Temperature2M accept
+// integers, floats and numeric strings alike, as open-meteo has sent each in edge responses.
+func (c *Current) UnmarshalJSON(data []byte) error {
+	type plain Current
+	tolerant := struct {
+		*plain
+		Interval      flexNumber `json:"interval"`
+		Temperature2M flexNumber `json:"temperature_2m"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &tolerant); err != nil {
+		return err
+	}
+	c.Interval = int(tolerant.Interval)
+	c.Temperature2M = float64(tolerant.Temperature2M)
+	if len(weatherCurrentVars) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for _, name := range weatherCurrentVars {
+		var value *float64
+		if err := json.Unmarshal(fields[name], &value); err != nil || value == nil {
+			continue
+		}
+		if c.Extra == nil {
+			c.Extra = make(map[string]float64)
+		}
+		c.Extra[name] = *value
+	}
+	return nil
+}
+
+// newWeatherProviders builds the ordered weather chain, each provider with its own breaker.
+// OpenWeatherMap needs an API key and is left out without one.
+func newWeatherProviders(names []string) []guardedWeatherProvider {
+	var providers []guardedWeatherProvider
+	for _, name := range names {
+		var provider WeatherProvider
+		switch name {
+		case "openmeteo":
+			provider = openMeteoProvider{}
+		case "openweathermap":
+			if openWeatherMapAPIKey == "" {
+				log.Printf("skipping weather provider %q: OPENWEATHERMAP_API_KEY is not set", name)
+				continue
+			}
+			provider = openWeatherMapProvider{apiKey: openWeatherMapAPIKey}
+		default:
+			log.Printf("ignoring unknown weather provider %q", name)
+			continue
+		}
+		providers = append(providers, guardedWeatherProvider{
+			WeatherProvider: provider,
+			breaker:         newCircuitBreaker(breakerFailureThreshold, breakerCooldown),
+			timeout:         newAdaptiveTimeout(name, weatherAPITimeout),
+		})
+	}
+	return providers
+}
+
+// LookupWeather walks the weather chain in order, skipping providers whose breaker is open,
+// and returns the response with the name of the provider that served it. degraded is true
+// when that wasn't the first provider in the chain.
+func LookupWeather(ctx context.Context, latitude, longitude, model string, vars ...string) (weather *WeatherApiResponse, provider string, degraded bool, err error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "LookupWeather")
+	defer span.End()
+
+	// Bad coordinates would fail on every provider; don't hold that against their breakers.
+	if _, err := strconv.ParseFloat(latitude, 64); err != nil {
+		return nil, "", false, fmt.Errorf("%w: %w", errInvalidCoordinates, err)
+	}
+	if _, err := strconv.ParseFloat(longitude, 64); err != nil {
+		return nil, "", false, fmt.Errorf("%w: %w", errInvalidCoordinates, err)
+	}
+
+	key := weatherCacheKey(latitude, longitude, model, vars)
+	entry, ok := cacheGet(ctx, weatherCache, "weather", key)
+	traceCacheLookup(ctx, "weather", key, ok, false)
+	if ok {
+		return &entry.Value.Weather, entry.Value.Provider, entry.Value.Degraded, nil
+	}
+
+	lastErr := errNoWeatherProviderAvailable
+	for i, candidate := range weatherProviders {
+		providerAttr := stringAttr("provider", candidate.Name())
+		if !candidate.breaker.Allow() {
+			span.AddEvent("skipped_open_breaker", trace.WithAttributes(providerAttr))
+			continue
+		}
+
+		var weather *WeatherApiResponse
+		err := candidate.timeout.Do(ctx, func(ctx context.Context) (err error) {
+			weather, err = candidate.Current(ctx, latitude, longitude, model, vars)
+			return err
+		})
+		if err == nil {
+			candidate.breaker.Success()
+			span.SetAttributes(stringAttr("weather.provider", candidate.Name()), attribute.Bool("weather.degraded", i > 0))
+			weatherCache.Set(key, cachedWeather{Weather: *weather, Provider: candidate.Name(), Degraded: i > 0}, weatherCacheTTL)
+			return weather, candidate.Name(), i > 0, nil
+		}
+
+		// A coverage gap is a property of the location, not a sign the provider is unhealthy.
+		if errors.Is(err, errNoWeatherCoverage) {
+			candidate.breaker.Success()
+		} else {
+			candidate.breaker.Failure()
+		}
+		span.AddEvent("provider_failed", trace.WithAttributes(providerAttr, stringAttr("error", err.Error())))
+		logFromCtx(ctx).Warn("provider failed, trying next", slog.String("provider", candidate.Name()), slog.String("error", err.Error()))
+		lastErr = err
+	}
+	return nil, "", false, lastErr
+}
+
+// weatherUnavailable reports whether err means the location has no current weather, as
+// opposed to the CEP not existing or a provider failing.
+func weatherUnavailable(err error) bool {
+	return errors.Is(err, errNoWeatherCoverage) || errors.Is(err, errNoCurrentConditions) || errors.Is(err, errNoCoordinates)
+}
+
+type OpenWeatherMapCoord struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type OpenWeatherMapMain struct {
+	Temp      float64  `json:"temp"`
+	FeelsLike *float64 `json:"feels_like"`
+	Humidity  *float64 `json:"humidity"`
+}
+
+type OpenWeatherMapWind struct {
+	Speed *float64 `json:"speed"`
+}
+
+type OpenWeatherMapResponse struct {
+	Coord OpenWeatherMapCoord `json:"coord"`
+	Main  OpenWeatherMapMain  `json:"main"`
+	Wind  OpenWeatherMapWind  `json:"wind"`
+	Dt    int64               `json:"dt"`
+}
+
+type openWeatherMapProvider struct {
+	apiKey string
+}
+
+func (openWeatherMapProvider) Name() string { return "openweathermap" }
+
+func (p openWeatherMapProvider) Current(ctx context.Context, latitude, longitude, _ string, vars []string) (*WeatherApiResponse, error) {
+	tracer := otel.Tracer("microservice-tracer")
+	ctx, span := tracer.Start(ctx, "OpenWeatherMapApi")
+	defer span.End()
+
+	query := url.Values{}
+	query.Set("lat", latitude)
+	query.Set("lon", longitude)
+	query.Set("units", "metric")
+	query.Set("appid", p.apiKey)
+	req, err := http.NewRequestWithContext(withUpstreamProvider(ctx, "openweathermap"), "GET", openWeatherMapBaseURL+"/data/2.5/weather?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readUpstreamBody("openweathermap", resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError("openweathermap", resp, body, fmt.Errorf("openweathermap api returned %d", resp.StatusCode))
+	}
+
+	var owmResponse OpenWeatherMapResponse
+	if err := decodeUpstreamJSON("openweathermap", resp, body, &owmResponse); err != nil {
+		return nil, err
+	}
+
+	weather := &WeatherApiResponse{
+		Latitude:  owmResponse.Coord.Lat,
+		Longitude: owmResponse.Coord.Lon,
+		Timezone:  "GMT",
+		Current: Current{
+			Time:                time.Unix(owmResponse.Dt, 0).UTC().Format("2006-01-02T15:04"),
+			Temperature2M:       owmResponse.Main.Temp,
+			ApparentTemperature: owmResponse.Main.FeelsLike,
+		},
+	}
+	if slices.Contains(vars, weatherVarHumidity) {
+		weather.Current.RelativeHumidity2M = owmResponse.Main.Humidity
+	}
+	// OpenWeatherMap reports wind in m/s with units=metric; open-meteo's default is km/h.
+	if speed := owmResponse.Wind.Speed; speed != nil && slices.Contains(vars, weatherVarWindSpeed) {
+		kmh := *speed * 3.6
+		weather.Current.WindSpeed10M = &kmh
+	}
+	return weather, nil
+}
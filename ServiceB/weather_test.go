@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNewWeatherCurrentVars(t *testing.T) {
+	got := newWeatherCurrentVars([]string{"relative_humidity_2m", "not_a_variable", "wind_speed_10m", "Temperature_2m"})
+	if want := []string{"relative_humidity_2m", "wind_speed_10m"}; !slices.Equal(got, want) {
+		t.Errorf("newWeatherCurrentVars = %v, want %v", got, want)
+	}
+}
+
+func TestCurrentAndDailyVariables(t *testing.T) {
+	tests := []struct {
+		name        string
+		configured  []string
+		vars        []string
+		wantCurrent string
+		wantDaily   string
+	}{
+		{
+			name:        "defaults",
+			wantCurrent: "temperature_2m,apparent_temperature",
+		},
+		{
+			name:        "WEATHER_CURRENT_VARS",
+			configured:  []string{"relative_humidity_2m", "wind_speed_10m"},
+			wantCurrent: "temperature_2m,apparent_temperature,relative_humidity_2m,wind_speed_10m",
+		},
+		{
+			name:        "repeats named once",
+			configured:  []string{"relative_humidity_2m", "temperature_2m"},
+			vars:        []string{"relative_humidity_2m", "uv_index"},
+			wantCurrent: "temperature_2m,apparent_temperature,relative_humidity_2m,uv_index",
+		},
+		{
+			name:        "daily variables go to daily=",
+			configured:  []string{"relative_humidity_2m"},
+			vars:        []string{weatherVarSunrise, weatherVarSunset, weatherVarSunrise},
+			wantCurrent: "temperature_2m,apparent_temperature,relative_humidity_2m",
+			wantDaily:   "sunrise,sunset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &weatherCurrentVars, tt.configured)
+			if got := currentVariables(tt.vars); got != tt.wantCurrent {
+				t.Errorf("currentVariables(%v) = %q, want %q", tt.vars, got, tt.wantCurrent)
+			}
+			if got := dailyVariables(tt.vars); got != tt.wantDaily {
+				t.Errorf("dailyVariables(%v) = %q, want %q", tt.vars, got, tt.wantDaily)
+			}
+		})
+	}
+}
+
+func TestWeatherApiFetchesCurrentVars(t *testing.T) {
+	var query map[string][]string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"current":{"time":"2024-05-01T12:00","interval":900,"temperature_2m":21.4,"relative_humidity_2m":78,"wind_speed_10m":null}}`))
+	}))
+	t.Cleanup(upstream.Close)
+	setForTest(t, &openMeteoBaseURL, upstream.URL)
+	setForTest(t, &weatherCurrentVars, []string{"relative_humidity_2m", "wind_speed_10m"})
+
+	got, err := WeatherApi(context.Background(), "-23.55", "-46.63", "")
+	if err != nil {
+		t.Fatalf("WeatherApi: %s", err)
+	}
+	if current := query["current"]; len(current) != 1 || current[0] != "temperature_2m,apparent_temperature,relative_humidity_2m,wind_speed_10m" {
+		t.Errorf("current = %q", current)
+	}
+	if _, ok := query["daily"]; ok {
+		t.Errorf("daily = %q, want no daily variables", query["daily"])
+	}
+	// A variable the provider left null is left out rather than reported as 0.
+	if len(got.Current.Extra) != 1 || got.Current.Extra["relative_humidity_2m"] != 78 {
+		t.Errorf("extra = %v, want only relative_humidity_2m", got.Current.Extra)
+	}
+}
+
+func TestCurrentAcceptsIntFloatAndStringNumbers(t *testing.T) {
+	tests := []struct {
+		interval    string
+		temperature string
+	}{
+		{interval: `900`, temperature: `21.4`},
+		{interval: `900.0`, temperature: `21.40`},
+		{interval: `"900"`, temperature: `"21.4"`},
+		{interval: `9e2`, temperature: `"2.14e1"`},
+	}
+	for _, tt := range tests {
+		var got Current
+		data := `{"time":"2024-05-01T12:00","interval":` + tt.interval + `,"temperature_2m":` + tt.temperature + `}`
+		if err := json.Unmarshal([]byte(data), &got); err != nil {
+			t.Errorf("%s: %s", data, err)
+			continue
+		}
+		if got.Time != "2024-05-01T12:00" || got.Interval != 900 || got.Temperature2M != 21.4 {
+			t.Errorf("%s: got %+v", data, got)
+		}
+	}
+
+	var got Current
+	if err := json.Unmarshal([]byte(`{"time":"2024-05-01T12:00","interval":900,"temperature_2m":21}`), &got); err != nil || got.Temperature2M != 21 {
+		t.Errorf("integer temperature: got %+v, %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(`{"interval":"fifteen minutes","temperature_2m":21.4}`), &got); err == nil {
+		t.Error("a non-numeric interval decoded without an error")
+	}
+}
+
+func TestHandlerCepStringNumbersFromOpenMeteo(t *testing.T) {
+	newFixtureServer(t, "success")
+	weather := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"current_units":{"temperature_2m":"°C"},"current":{"time":"2024-05-01T12:00","interval":"900","temperature_2m":"21.4"}}`))
+	}))
+	t.Cleanup(weather.Close)
+	setForTest(t, &openMeteoBaseURL, weather.URL)
+
+	rec := serveCep(t, "/01001000")
+	var got Temperature
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got.TempC != 21.4 {
+		t.Errorf("got %+v, want 21.4°C", got)
+	}
+}
@@ -0,0 +1,109 @@
+// Package cep parses the ways clients write a Brazilian postal code (CEP) into the canonical
+// form both services look it up by.
+package cep
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrEmpty    = errors.New("empty")
+	ErrFormat   = errors.New("not 8 digits, 00000-000 or 00000 000")
+	ErrRejected = errors.New("rejected by CEP_VALIDATION_REGEX")
+)
+
+// InvalidError is what Parse returns for input it can't turn into a CEP. Reason is one of
+// the Err* values.
+type InvalidError struct {
+	Input  string
+	Reason error
+}
+
+func (e *InvalidError) Error() string {
+	return fmt.Sprintf("invalid cep %q: %s", e.Input, e.Reason)
+}
+
+func (e *InvalidError) Unwrap() error { return e.Reason }
+
+// Parser turns client input into a CEP. The zero value accepts the standard formats.
+type Parser struct {
+	// Pad restores the leading zero spreadsheets tend to drop (1001000 -> 01001000).
+	Pad bool
+	// Override, when set, replaces the standard formats: the trimmed, padded input is the CEP
+	// if it matches, as is, and is rejected otherwise. It is for special administrative CEPs
+	// the standard formats don't cover. It must match the whole input, as the one NewParser
+	// compiles does; a partial match would let anything around the CEP through to upstream URLs.
+	Override *regexp.Regexp
+}
+
+// NewParser builds a Parser whose Override is compiled from pattern, anchored at both ends,
+// "" meaning none.
+func NewParser(pad bool, pattern string) (*Parser, error) {
+	p := &Parser{Pad: pad}
+	if pattern != "" {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		p.Override = re
+	}
+	return p, nil
+}
+
+// formats are the standard ways of writing a CEP, tried in order. Each returns the CEP as 8
+// digits, or false when the input isn't in its format.
+var formats = []func(string) (string, bool){
+	plain,
+	separated('-'),
+	separated(' '),
+}
+
+func plain(s string) (string, bool) {
+	return s, len(s) == 8 && isDigits(s)
+}
+
+// separated accepts 00000-000 style CEPs with sep between the prefix and the suffix.
+func separated(sep byte) func(string) (string, bool) {
+	return func(s string) (string, bool) {
+		if len(s) != 9 || s[5] != sep || !isDigits(s[:5]) || !isDigits(s[6:]) {
+			return "", false
+		}
+		return s[:5] + s[6:], true
+	}
+}
+
+func isDigits(s string) bool {
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse trims raw and returns the CEP it stands for, or an *InvalidError saying why there is
+// none.
+func (p *Parser) Parse(raw string) (string, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return "", &InvalidError{Input: raw, Reason: ErrEmpty}
+	}
+	if p.Pad && len(s) == 7 && isDigits(s) {
+		s = "0" + s
+	}
+	if p.Override != nil {
+		if !p.Override.MatchString(s) {
+			return "", &InvalidError{Input: raw, Reason: ErrRejected}
+		}
+		return s, nil
+	}
+	for _, format := range formats {
+		if cep, ok := format(s); ok {
+			return cep, nil
+		}
+	}
+	return "", &InvalidError{Input: raw, Reason: ErrFormat}
+}
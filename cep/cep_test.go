@@ -0,0 +1,94 @@
+package cep
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		parser  Parser
+		input   string
+		want    string
+		wantErr error
+	}{
+		{name: "plain", input: "01001000", want: "01001000"},
+		{name: "dashed", input: "01001-000", want: "01001000"},
+		{name: "spaced", input: "01001 000", want: "01001000"},
+		{name: "surrounding whitespace", input: " \t01001-000\n", want: "01001000"},
+		{name: "non-breaking space trimmed", input: "01001000\u00a0", want: "01001000"},
+
+		{name: "empty", input: "", wantErr: ErrEmpty},
+		{name: "only whitespace", input: "   ", wantErr: ErrEmpty},
+		{name: "seven digits", input: "1001000", wantErr: ErrFormat},
+		{name: "nine digits", input: "010010000", wantErr: ErrFormat},
+		{name: "letters", input: "0100100a", wantErr: ErrFormat},
+		{name: "dash misplaced", input: "0100-1000", wantErr: ErrFormat},
+		{name: "dot separator", input: "01001.000", wantErr: ErrFormat},
+		{name: "two separators", input: "01001--000", wantErr: ErrFormat},
+		{name: "inner space and dash", input: "01001 -000", wantErr: ErrFormat},
+		{name: "full-width digit", input: "０1001000", wantErr: ErrFormat},
+		{name: "signed number", input: "+1001000", wantErr: ErrFormat},
+
+		{name: "padded seven digits", parser: Parser{Pad: true}, input: "1001000", want: "01001000"},
+		{name: "padding keeps eight digits", parser: Parser{Pad: true}, input: "01001000", want: "01001000"},
+		{name: "padding still rejects six digits", parser: Parser{Pad: true}, input: "101000", wantErr: ErrFormat},
+		{name: "padding still rejects nine digits", parser: Parser{Pad: true}, input: "101001000", wantErr: ErrFormat},
+		{name: "padding only pads digits", parser: Parser{Pad: true}, input: "100100a", wantErr: ErrFormat},
+		{name: "padding does not apply to dashed", parser: Parser{Pad: true}, input: "1001-000", wantErr: ErrFormat},
+
+		{name: "override accepts a special cep", parser: Parser{Override: regexp.MustCompile(`^\d{8}$|^SP\d{6}$`)}, input: "SP010010", want: "SP010010"},
+		{name: "override accepts a plain cep", parser: Parser{Override: regexp.MustCompile(`^\d{8}$|^SP\d{6}$`)}, input: "01001000", want: "01001000"},
+		{name: "override replaces standard formats", parser: Parser{Override: regexp.MustCompile(`^\d{8}$`)}, input: "01001-000", wantErr: ErrRejected},
+		{name: "override rejects", parser: Parser{Override: regexp.MustCompile(`^\d{8}$`)}, input: "SP010010", wantErr: ErrRejected},
+		{name: "override sees padded input", parser: Parser{Pad: true, Override: regexp.MustCompile(`^0\d{7}$`)}, input: "1001000", want: "01001000"},
+		{name: "override still rejects empty", parser: Parser{Override: regexp.MustCompile(`.*`)}, input: " ", wantErr: ErrEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parser.Parse(tt.input)
+			if tt.wantErr != nil {
+				var invalid *InvalidError
+				if !errors.As(err, &invalid) || !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Parse(%q) error = %v, want an *InvalidError for %v", tt.input, err, tt.wantErr)
+				}
+				if invalid.Input != tt.input {
+					t.Errorf("Input = %q, want %q", invalid.Input, tt.input)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Parse(%q) = %q, %v, want %q", tt.input, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewParser(t *testing.T) {
+	if _, err := NewParser(false, "("); err == nil {
+		t.Error("NewParser accepted a pattern that doesn't compile")
+	}
+	p, err := NewParser(true, "")
+	if err != nil || p.Override != nil || !p.Pad {
+		t.Errorf("NewParser(true, \"\") = %+v, %v", p, err)
+	}
+
+	// The pattern has to match the whole input, not just somewhere in it.
+	p, err = NewParser(false, `\d{8}|SP\d{6}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for input, wantErr := range map[string]error{
+		"01001000":          nil,
+		"SP010010":          nil,
+		"01001000/../x?y=":  ErrRejected,
+		"../01001000":       ErrRejected,
+		"SP010010#fragment": ErrRejected,
+	} {
+		if got, err := p.Parse(input); !errors.Is(err, wantErr) || err == nil && got != input {
+			t.Errorf("Parse(%q) = %q, %v, want err %v", input, got, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package temperature converts Celsius readings to the other scales the services report.
+// Every scale is derived from Celsius, never from another derived value, so rounding in one
+// can't leak into the next.
+package temperature
+
+// Temperature is one reading in Celsius, Fahrenheit and Kelvin.
+type Temperature struct {
+	TempC float64 `json:"temp_C"`
+	TempF float64 `json:"temp_F"`
+	TempK float64 `json:"temp_K"`
+}
+
+// FromCelsius returns the reading c °C in all three scales.
+func FromCelsius(c float64) Temperature {
+	return Temperature{
+		TempC: c,
+		TempF: CelsiusToFahrenheit(c),
+		TempK: CelsiusToKelvin(c),
+	}
+}
+
+// CelsiusToFahrenheit converts c °C to °F.
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*1.8 + 32
+}
+
+// CelsiusToKelvin converts c °C to K.
+func CelsiusToKelvin(c float64) float64 {
+	return c + 273.15
+}
@@ -0,0 +1,29 @@
+package temperature
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFromCelsius(t *testing.T) {
+	tests := []struct {
+		c    float64
+		want Temperature
+	}{
+		{c: 0, want: Temperature{TempC: 0, TempF: 32, TempK: 273.15}},
+		{c: 100, want: Temperature{TempC: 100, TempF: 212, TempK: 373.15}},
+		{c: -40, want: Temperature{TempC: -40, TempF: -40, TempK: 233.15}},
+		{c: 21.4, want: Temperature{TempC: 21.4, TempF: 70.52, TempK: 294.55}},
+		{c: -273.15, want: Temperature{TempC: -273.15, TempF: -459.67, TempK: 0}},
+	}
+	for _, tt := range tests {
+		got := FromCelsius(tt.c)
+		if got.TempC != tt.want.TempC || !near(got.TempF, tt.want.TempF) || !near(got.TempK, tt.want.TempK) {
+			t.Errorf("FromCelsius(%v) = %+v, want %+v", tt.c, got, tt.want)
+		}
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}